@@ -0,0 +1,62 @@
+// Package archive stores the records of finished jobs outside of benchapi's
+// storage before they expire from it.
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Dir archives to a directory, such as a mounted volume.
+type Dir struct {
+	dir string
+}
+
+func NewDir(dir string) *Dir {
+	return &Dir{
+		dir: dir,
+	}
+}
+
+// Put writes data to the file named key, a slash separated path under the
+// directory. The file is written to a temporary file and renamed, so it is
+// never seen half written.
+func (d *Dir) Put(key string, data []byte) error {
+	key = path.Clean("/" + key)
+	if key == "/" {
+		return errors.Errorf("invalid key %q", key)
+	}
+
+	p := filepath.Join(d.dir, filepath.FromSlash(key))
+
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return errors.Wrap(err, "error creating directory")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return errors.Wrap(err, "error creating file")
+	}
+
+	_, err = tmp.Write(data)
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "error writing %s", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package archive_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/rickbassham/bench/archive"
+)
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := archive.NewDir(dir)
+
+	if err := a.Put("run1/job.json", []byte("{}")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := a.Put("../run2/job.json", []byte("[]")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "run1", "job.json"))
+	if err != nil || string(data) != "{}" {
+		t.Errorf("expected the archived file, got %q %v", data, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "run2", "job.json")); err != nil {
+		t.Errorf("expected keys to stay in the directory, got %v", err)
+	}
+}
+
+// minio stands in for an S3 compatible store, keeping the objects it is sent.
+type minio struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *minio) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+
+	if r.Method != http.MethodPut || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		w.WriteHeader(403)
+		return
+	}
+
+	if r.ContentLength < 0 {
+		w.WriteHeader(411)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(400)
+		w.Write([]byte("XAmzContentSHA256Mismatch"))
+		return
+	}
+
+	m.mu.Lock()
+	m.objects[r.URL.Path] = body
+	m.mu.Unlock()
+}
+
+func TestS3(t *testing.T) {
+	m := &minio{objects: map[string][]byte{}}
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	a := archive.NewS3(srv.URL+"/", "results", "us-east-1", credentials.NewStaticCredentials("key", "secret", ""))
+
+	if err := a.Put("run1/data/feeder", []byte("id\n1\n")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if string(m.objects["/results/run1/data/feeder"]) != "id\n1\n" {
+		t.Errorf("expected the object to be uploaded, got %v", m.objects)
+	}
+
+	denied := archive.NewS3(srv.URL, "results", "eu-west-1", credentials.NewStaticCredentials("key", "secret", ""))
+
+	if err := denied.Put("run1/job.json", []byte("{}")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected a rejected upload to fail, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/pkg/errors"
+)
+
+// S3 archives to a bucket of Amazon S3 or an S3 compatible object store such
+// as MinIO. Objects are addressed path style, as endpoint/bucket/key, which
+// every such store supports.
+type S3 struct {
+	endpoint string
+	bucket   string
+	region   string
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// NewS3 returns an archiver for bucket at endpoint, such as
+// https://s3.us-east-1.amazonaws.com or http://minio:9000.
+func NewS3(endpoint, bucket, region string, creds *credentials.Credentials) *S3 {
+	return &S3{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   bucket,
+		region:   region,
+		signer:   v4.NewSigner(creds),
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Put uploads data as the object named key.
+func (s *S3) Put(key string, data []byte) error {
+	u := s.endpoint + "/" + s.bucket + "/" + (&url.URL{Path: key}).EscapedPath()
+
+	req, err := http.NewRequest(http.MethodPut, u, nil)
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	_, err = s.signer.Sign(req, bytes.NewReader(data), "s3", s.region, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "error signing request")
+	}
+
+	// S3 needs the length up front, which is lost when Sign sets the body.
+	req.ContentLength = int64(len(data))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error uploading %s", key)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("error uploading %s: %s: %s", key, res.Status, body)
+	}
+
+	return nil
+}
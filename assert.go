@@ -0,0 +1,121 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Assertion types.
+const (
+	// AssertStatus checks the status code is within Min and Max.
+	AssertStatus = "status"
+	// AssertBodyContains checks the body contains Value.
+	AssertBodyContains = "bodyContains"
+	// AssertBodyRegex checks the body matches the regular expression Value.
+	AssertBodyRegex = "bodyRegex"
+	// AssertJSONPath checks the value at Path in a JSON body equals Value.
+	AssertJSONPath = "jsonPath"
+	// AssertMaxBodySize checks the body is at most Max bytes.
+	AssertMaxBodySize = "maxBodySize"
+	// AssertHeader checks the header Path is present and, if Value is set,
+	// equal to it.
+	AssertHeader = "header"
+)
+
+func (a Assertion) Validate() error {
+	switch a.Type {
+	case AssertStatus:
+		if a.Min <= 0 || a.Max < a.Min {
+			return errors.New("status assertion needs 0 < min <= max")
+		}
+	case AssertBodyContains:
+		if a.Value == "" {
+			return errors.New("bodyContains assertion needs a value")
+		}
+	case AssertBodyRegex:
+		_, err := regexp.Compile(a.Value)
+		if err != nil {
+			return errors.Wrap(err, "bodyRegex assertion")
+		}
+	case AssertJSONPath, AssertHeader:
+		if a.Path == "" {
+			return errors.Errorf("%s assertion needs a path", a.Type)
+		}
+	case AssertMaxBodySize:
+		if a.Max <= 0 {
+			return errors.New("maxBodySize assertion needs max > 0")
+		}
+	default:
+		return errors.Errorf("unknown assertion type %q", a.Type)
+	}
+
+	return nil
+}
+
+// needsBody reports whether checking a needs the response body.
+func (a Assertion) needsBody() bool {
+	switch a.Type {
+	case AssertBodyContains, AssertBodyRegex, AssertJSONPath:
+		return true
+	}
+
+	return false
+}
+
+// defaultName describes the assertion, for results breakdowns of assertions
+// that were not given a name.
+func (a Assertion) defaultName() string {
+	switch a.Type {
+	case AssertStatus:
+		return fmt.Sprintf("status %d-%d", a.Min, a.Max)
+	case AssertMaxBodySize:
+		return fmt.Sprintf("maxBodySize %d", a.Max)
+	case AssertJSONPath:
+		return fmt.Sprintf("jsonPath %s == %s", a.Path, a.Value)
+	case AssertHeader:
+		if a.Value != "" {
+			return fmt.Sprintf("header %s == %s", a.Path, a.Value)
+		}
+
+		return fmt.Sprintf("header %s", a.Path)
+	}
+
+	return fmt.Sprintf("%s %s", a.Type, a.Value)
+}
+
+// check reports whether the response satisfies the assertion.
+func (a Assertion) check(resp *http.Response, body []byte, size int) bool {
+	switch a.Type {
+	case AssertStatus:
+		return resp.StatusCode >= a.Min && resp.StatusCode <= a.Max
+	case AssertBodyContains:
+		return bytes.Contains(body, []byte(a.Value))
+	case AssertBodyRegex:
+		return a.re != nil && a.re.Match(body)
+	case AssertJSONPath:
+		var doc interface{}
+		if json.Unmarshal(body, &doc) != nil {
+			return false
+		}
+
+		v, ok := jsonPath(doc, a.Path)
+
+		return ok && v == a.Value
+	case AssertMaxBodySize:
+		return size <= a.Max
+	case AssertHeader:
+		values, ok := resp.Header[http.CanonicalHeaderKey(a.Path)]
+		if !ok {
+			return false
+		}
+
+		return a.Value == "" || (len(values) > 0 && values[0] == a.Value)
+	}
+
+	return false
+}
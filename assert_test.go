@@ -0,0 +1,73 @@
+package bench_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestRunnerAssertions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"error","id":1000000,"items":[]}`))
+	}))
+	defer srv.Close()
+
+	spec := bench.RequestSpec{
+		URL: srv.URL,
+		Assertions: []bench.Assertion{
+			{Type: bench.AssertStatus, Min: 200, Max: 299},
+			{Type: bench.AssertHeader, Path: "content-type", Value: "application/json"},
+			{Name: "ok", Type: bench.AssertJSONPath, Path: "status", Value: "ok"},
+			{Name: "id", Type: bench.AssertJSONPath, Path: "id", Value: "1000000"},
+			{Type: bench.AssertBodyContains, Value: "items"},
+			{Type: bench.AssertBodyRegex, Value: `"items":\[\]`},
+			{Type: bench.AssertMaxBodySize, Max: 10},
+		},
+	}
+
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bench.NewRunner(1, 100*time.Millisecond, 100*time.Millisecond, "", nil, bench.WithRequest(spec))
+
+	result := r.Run()
+
+	if result.Requests == 0 || result.AssertionFailures != result.Requests {
+		t.Fatalf("expected every response to fail, got %d failures for %d requests", result.AssertionFailures, result.Requests)
+	}
+
+	want := map[string]int{
+		"ok":             result.Requests,
+		"maxBodySize 10": result.Requests,
+	}
+
+	if len(result.Assertions) != len(want) {
+		t.Errorf("expected only the failing assertions, got %v", result.Assertions)
+	}
+
+	for name, n := range want {
+		if result.Assertions[name] != n {
+			t.Errorf("%s: expected %d failures, got %d", name, n, result.Assertions[name])
+		}
+	}
+}
+
+func TestAssertionValidate(t *testing.T) {
+	invalid := []bench.Assertion{
+		{Type: bench.AssertStatus, Min: 300, Max: 200},
+		{Type: bench.AssertBodyRegex, Value: "("},
+		{Type: bench.AssertJSONPath},
+		{Type: "nope"},
+	}
+
+	for _, a := range invalid {
+		if a.Validate() == nil {
+			t.Errorf("%+v: expected an error", a)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// Scopes of the API keys used to call the user facing endpoints.
+const (
+	scopeStart  = "start"
+	scopeRead   = "read"
+	scopeCancel = "cancel"
+)
+
+var allScopes = []string{scopeStart, scopeRead, scopeCancel}
+
+// apiKeys maps each API key to its scopes. With no keys configured the user
+// facing endpoints are open.
+var apiKeys map[string][]string
+
+// parseAPIKeys reads keys configured as a comma separated list of key:scopes,
+// with scopes separated by "|", such as "k1:start|read|cancel,k2:read". A key
+// without scopes has all of them.
+func parseAPIKeys(s string) (map[string][]string, error) {
+	keys := map[string][]string{}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if parts[0] == "" {
+			return nil, errors.New("empty api key")
+		}
+
+		if len(parts) == 1 || parts[1] == "" {
+			keys[parts[0]] = allScopes
+			continue
+		}
+
+		var scopes []string
+
+		for _, scope := range strings.Split(parts[1], "|") {
+			switch scope {
+			case scopeStart, scopeRead, scopeCancel:
+				scopes = append(scopes, scope)
+			default:
+				return nil, errors.Errorf("unknown scope %q", scope)
+			}
+		}
+
+		keys[parts[0]] = scopes
+	}
+
+	return keys, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// requireScope only lets requests with an API key that has scope through to
+// next.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+
+		for key, scopes := range apiKeys {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+				continue
+			}
+
+			for _, s := range scopes {
+				if s == scope {
+					next(w, r)
+					return
+				}
+			}
+
+			w.WriteHeader(403)
+			w.Write([]byte("api key does not allow " + scope))
+			return
+		}
+
+		w.WriteHeader(401)
+		w.Write([]byte("missing or unknown api key"))
+	}
+}
+
+// newTaskToken returns a secret for a runner to authenticate with, and the
+// hash of it kept on its task.
+func newTaskToken() (string, string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error generating token")
+	}
+
+	token := hex.EncodeToString(b)
+
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorizeTask checks that the request carries the token issued to task,
+// writing a 401 if it does not.
+func authorizeTask(w http.ResponseWriter, r *http.Request, task bench.Task) bool {
+	token := bearerToken(r)
+
+	if task.TokenHash == "" || token == "" || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(task.TokenHash)) != 1 {
+		w.WriteHeader(401)
+		w.Write([]byte("invalid runner token"))
+		return false
+	}
+
+	return true
+}
+
+// issueToken sets the hash of a new token on task and returns the token,
+// which is only handed to the task's container.
+func issueToken(task *bench.Task) (string, error) {
+	token, hash, err := newTaskToken()
+	if err != nil {
+		return "", err
+	}
+
+	task.TokenHash = hash
+
+	return token, nil
+}
+
+// launch starts a container for the saved task with env plus its token, and
+// then records the container on the task, moving it to provisioning unless
+// its runner has already said it is ready.
+func launch(runID string, task *bench.Task, token string, env map[string]string, now time.Time) error {
+	containerEnv := map[string]string{"BENCH_TOKEN": token}
+	for k, v := range env {
+		containerEnv[k] = v
+	}
+
+	containerID, err := cm.StartContainer(containerEnv)
+	if err != nil {
+		return errors.Wrap(err, "error starting container")
+	}
+
+	*task, err = sm.ModifyTask(runID, task.ID, func(t *bench.Task) error {
+		t.ContainerID = containerID
+
+		if t.State == bench.StatePending {
+			return t.Transition(bench.StateProvisioning, now)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error saving task")
+	}
+
+	publishTask(runID, task.ID, eventStarted, nil)
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys(" k1:start|read , k2, ,k3:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"k1": {scopeStart, scopeRead},
+		"k2": allScopes,
+		"k3": {scopeRead},
+	}
+
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected keys %v, got %v", want, keys)
+	}
+
+	for _, s := range []string{":read", "k1:write", "k1:read|"} {
+		if _, err := parseAPIKeys(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	defer func() { apiKeys = nil }()
+
+	tests := []struct {
+		name   string
+		keys   string
+		auth   string
+		status int
+	}{
+		{name: "no keys configured", status: 200},
+		{name: "no key", keys: "k1:read", status: 401},
+		{name: "unknown key", keys: "k1:read", auth: "Bearer k2", status: 401},
+		{name: "not a bearer token", keys: "k1:read", auth: "k1", status: 401},
+		{name: "missing scope", keys: "k1:read,k2:cancel", auth: "Bearer k2", status: 403},
+		{name: "scope", keys: "k1:read,k2:cancel", auth: "Bearer k1", status: 200},
+		{name: "every scope", keys: "k1", auth: "Bearer k1", status: 200},
+	}
+
+	handler := requireScope(scopeRead, func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range tests {
+		var err error
+
+		apiKeys, err = parseAPIKeys(tt.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "/result", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+}
+
+func TestAuthorizeTask(t *testing.T) {
+	var task, other bench.Task
+
+	token, err := issueToken(&task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherToken, err := issueToken(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		task  bench.Task
+		token string
+		ok    bool
+	}{
+		{name: "token", task: task, token: token, ok: true},
+		{name: "no token", task: task},
+		{name: "wrong token", task: task, token: "wrong"},
+		{name: "token of another task", task: task, token: otherToken},
+		{name: "the hash as token", task: task, token: task.TokenHash},
+		{name: "task without a token", task: bench.Task{}, token: token},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/heartbeat", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		w := httptest.NewRecorder()
+
+		ok := authorizeTask(w, r, tt.task)
+		if ok != tt.ok {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.ok, ok)
+		}
+
+		if !ok && w.Code != 401 {
+			t.Errorf("%s: expected 401, got %d", tt.name, w.Code)
+		}
+	}
+}
+
+func TestHeartbeatEnded(t *testing.T) {
+	task := newTask("a", bench.StateCancelled, time.Now())
+
+	token, err := issueToken(&task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setup(newJob(bench.StateRunning, time.Now(), task))
+
+	r := httptest.NewRequest("POST", "/heartbeat?runId=run&runnerId=a", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	heartbeat(w, r)
+
+	if w.Code != 410 || w.Body.String() != "task is cancelled" {
+		t.Errorf("expected 410 task is cancelled, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// comparison is the response of /compare.
+type comparison struct {
+	Base      string `json:"base"`
+	Candidate string `json:"candidate"`
+	bench.Comparison
+}
+
+// compare compares the merged results of the jobs base and candidate, which
+// must have ended. The thresholds default to bench.DefaultThresholds and may
+// be set by the throughput, errorRate, latency and significance query
+// parameters. The verdict is in the pass field, so CI can fail on it.
+func compare(w http.ResponseWriter, r *http.Request) {
+	log.Println("compare")
+
+	q := r.URL.Query()
+
+	if q.Get("base") == "" || q.Get("candidate") == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("base and candidate are required"))
+		return
+	}
+
+	th := bench.DefaultThresholds
+
+	for name, v := range map[string]*float64{
+		"throughput":   &th.Throughput,
+		"errorRate":    &th.ErrorRate,
+		"latency":      &th.Latency,
+		"significance": &th.Significance,
+	} {
+		if q.Get(name) == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(q.Get(name), 64)
+		if err != nil || f < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte(name + " must be >= 0"))
+			return
+		}
+
+		*v = f
+	}
+
+	var results [2]bench.Result
+
+	for i, runID := range []string{q.Get("base"), q.Get("candidate")} {
+		output, err := loadResult(runID)
+		if errors.Cause(err) == bench.ErrHistogramMismatch {
+			w.WriteHeader(409)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+
+		if !output.Job.State.Terminal() {
+			w.WriteHeader(409)
+			w.Write([]byte(fmt.Sprintf("job %s has not ended", runID)))
+			return
+		}
+
+		results[i] = output.Result
+	}
+
+	json.NewEncoder(w).Encode(&comparison{
+		Base:       q.Get("base"),
+		Candidate:  q.Get("candidate"),
+		Comparison: bench.Compare(results[0], results[1], th),
+	})
+}
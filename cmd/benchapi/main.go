@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,29 +24,102 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
+	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
 	"github.com/rickbassham/bench"
+	"github.com/rickbassham/bench/archive"
 	"github.com/rickbassham/bench/container"
 	"github.com/rickbassham/bench/storage"
 )
 
 type ContainerManager interface {
 	StartContainer(env map[string]string) (string, error)
+	StopContainer(id string) error
 	GetLogs(id string) (string, error)
 }
 
 type StorageManager interface {
-	SaveTask(runID string, t bench.Task) error
+	SaveTask(runID string, t *bench.Task) error
+	ModifyTask(runID, taskID string, f func(t *bench.Task) error) (bench.Task, error)
 	GetTask(runID, taskID string) (bench.Task, error)
-	SaveJob(j bench.Job) error
+	AddTask(runID string, t *bench.Task) error
+	SaveJob(j *bench.Job) error
+	UpdateJob(j *bench.Job) error
 	GetJob(runID string) (bench.Job, error)
+	ActiveJobs() ([]string, error)
+	ListJobs(q storage.JobQuery) (storage.JobList, error)
+	SaveData(runID, name string, data []byte) error
+	GetData(runID, name string) ([]byte, error)
+	EndedJobs(before time.Time) ([]string, error)
+	RetireJob(runID string, summary []byte, retention storage.Retention) error
+	GetSummary(runID string) ([]byte, error)
+	Purge(now time.Time) error
+}
+
+// newStorage returns the storage backend named kind: redis, postgres or file.
+func newStorage(kind string) (StorageManager, error) {
+	switch kind {
+	case "redis":
+		r := redis.NewClient(&redis.Options{
+			Addr:     viper.GetString("redis-address"),
+			Password: viper.GetString("redis-auth"),
+		})
+
+		return storage.NewRedis(r), nil
+	case "postgres":
+		db, err := sql.Open("postgres", viper.GetString("postgres-url"))
+		if err != nil {
+			return nil, errors.Wrap(err, "error opening postgres")
+		}
+
+		p := storage.NewPostgres(db)
+
+		err = p.Migrate()
+		if err != nil {
+			return nil, errors.Wrap(err, "error migrating postgres")
+		}
+
+		return p, nil
+	case "file":
+		return storage.NewFile(viper.GetString("data-dir"))
+	}
+
+	return nil, errors.Errorf("unknown storage %q", kind)
 }
 
 var cm ContainerManager
 var sm StorageManager
 var maxPerContainer int
+var reportInterval time.Duration
+
+// newArchiver returns the archiver set by archive-dir or archive-s3-bucket, or
+// nil if neither is set.
+func newArchiver() (Archiver, error) {
+	if dir := viper.GetString("archive-dir"); dir != "" {
+		return archive.NewDir(dir), nil
+	}
+
+	bucket := viper.GetString("archive-s3-bucket")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating aws session")
+	}
+
+	region := viper.GetString("archive-s3-region")
+
+	endpoint := viper.GetString("archive-s3-endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	return archive.NewS3(endpoint, bucket, region, sess.Config.Credentials), nil
+}
 
 func main() {
 	var err error
@@ -59,14 +135,31 @@ func main() {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 
-	maxPerContainer = viper.GetInt("max-per-container")
+	viper.SetDefault("start-delay", 3*time.Second)
+	viper.SetDefault("ready-timeout", 5*time.Minute)
+	viper.SetDefault("heartbeat-timeout", 30*time.Second)
+	viper.SetDefault("result-grace", time.Minute)
+	viper.SetDefault("watchdog-interval", 10*time.Second)
+	viper.SetDefault("storage", "redis")
+	viper.SetDefault("data-dir", "data")
+	viper.SetDefault("archive-s3-region", "us-east-1")
 
-	r := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("redis-address"),
-		Password: viper.GetString("redis-auth"),
-	})
+	maxPerContainer = viper.GetInt("max-per-container")
+	reportInterval = viper.GetDuration("report-interval")
+	startDelay = viper.GetDuration("start-delay")
+	readyTimeout = viper.GetDuration("ready-timeout")
+	heartbeatTimeout = viper.GetDuration("heartbeat-timeout")
+	resultGrace = viper.GetDuration("result-grace")
+	retention = storage.Retention{
+		Raw:     viper.GetDuration("retention-raw"),
+		Summary: viper.GetDuration("retention-summary"),
+	}
 
-	sm = storage.NewRedis(r)
+	sm, err = newStorage(viper.GetString("storage"))
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+		return
+	}
 
 	if viper.GetString("env") == "development" {
 		var c *client.Client
@@ -97,14 +190,41 @@ func main() {
 			viper.GetBool("public-ip"))
 	}
 
+	archiver, err = newArchiver()
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+		return
+	}
+
+	apiKeys, err = parseAPIKeys(viper.GetString("api-keys"))
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error parsing api keys")))
+		return
+	}
+
+	if len(apiKeys) == 0 {
+		log.Println("no api keys configured, user endpoints are open")
+	}
+
+	go watchdog(viper.GetDuration("watchdog-interval"))
+
 	http.HandleFunc("/health", health)
-	http.HandleFunc("/start", start)
+	http.HandleFunc("/start", requireScope(scopeStart, start))
+	http.HandleFunc("/cancel", requireScope(scopeCancel, cancel))
+	http.HandleFunc("/result", requireScope(scopeRead, result))
+	http.HandleFunc("/stream", requireScope(scopeRead, stream))
+	http.HandleFunc("/logs", requireScope(scopeRead, logs))
+	http.HandleFunc("/tasks", requireScope(scopeRead, tasks))
+	http.HandleFunc("/jobs", requireScope(scopeRead, jobs))
+	http.HandleFunc("/compare", requireScope(scopeRead, compare))
+
+	// Runners authenticate with the token of their task instead.
 	http.HandleFunc("/readyToStart", readyToStart)
 	http.HandleFunc("/waitForStart", waitForStart)
+	http.HandleFunc("/heartbeat", heartbeat)
+	http.HandleFunc("/reportProgress", reportProgress)
 	http.HandleFunc("/reportResult", reportResult)
-	http.HandleFunc("/result", result)
-	http.HandleFunc("/logs", logs)
-	http.HandleFunc("/tasks", tasks)
+	http.HandleFunc("/data", data)
 
 	err = http.ListenAndServe(":3000", nil)
 	if err != nil {
@@ -124,35 +244,350 @@ func writeErr(w http.ResponseWriter, err error) {
 	return
 }
 
+// writeConflict rejects a request that does not fit the state of the job or
+// task it is for.
+func writeConflict(w http.ResponseWriter, err error) {
+	w.WriteHeader(409)
+	w.Write([]byte(err.Error()))
+	log.Println(err.Error())
+}
+
+// writeSaveErr reports a failed save, which is a conflict if the storage
+// rejected the change of state or the job or task changed while saving it.
+func writeSaveErr(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case bench.ErrInvalidTransition, storage.ErrVersionConflict:
+		writeConflict(w, err)
+		return
+	}
+
+	writeErr(w, err)
+}
+
+// jobSpec is the JSON body accepted by /start. For backwards compatibility a
+// flat object of strings is still accepted as the job metadata.
+//
+// A job with a feeder or an access log to replay is sent as
+// multipart/form-data instead, with the JSON in a "spec" field and the files
+// in "feeder" and "replay" fields.
+type jobSpec struct {
+	MetaData map[string]string   `json:"meta"`
+	Stages   []bench.Stage       `json:"stages"`
+	Request  *bench.RequestSpec  `json:"request"`
+	Scenario *bench.Scenario     `json:"scenario"`
+	Requests []bench.RequestSpec `json:"requests"`
+
+	Generators map[string]string `json:"generators"`
+	Feeder     *bench.FeederSpec `json:"feeder"`
+	Replay     *bench.ReplaySpec `json:"replay"`
+
+	Histogram bench.HistogramSpec `json:"histogram"`
+}
+
+// maxUploadSize is the most memory used to hold an uploaded dataset; larger
+// uploads are spooled to disk while parsing.
+const maxUploadSize = 32 << 20
+
+func decodeStart(r *http.Request) (jobSpec, map[string][]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		spec, err := decodeJobSpec(r.Body)
+		return spec, nil, err
+	}
+
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		return jobSpec{}, nil, errors.Wrap(err, "error parsing form")
+	}
+
+	spec, err := decodeJobSpec(strings.NewReader(r.FormValue("spec")))
+	if err != nil {
+		return spec, nil, err
+	}
+
+	files := map[string][]byte{}
+
+	for name := range r.MultipartForm.File {
+		f, _, err := r.FormFile(name)
+		if err != nil {
+			return spec, nil, errors.Wrapf(err, "error opening %s", name)
+		}
+
+		files[name], err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return spec, nil, errors.Wrapf(err, "error reading %s", name)
+		}
+	}
+
+	return spec, files, nil
+}
+
+func decodeJobSpec(body io.Reader) (jobSpec, error) {
+	var spec jobSpec
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return spec, errors.Wrap(err, "error reading body")
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return spec, nil
+	}
+
+	if json.Unmarshal(data, &spec.MetaData) == nil {
+		return spec, nil
+	}
+
+	spec.MetaData = nil
+
+	err = json.Unmarshal(data, &spec)
+	if err != nil {
+		return spec, errors.Wrap(err, "error decoding body")
+	}
+
+	return spec, nil
+}
+
 func start(w http.ResponseWriter, r *http.Request) {
 	log.Println("info")
 
 	q := r.URL.Query()
 
-	concurrency64, err := strconv.ParseInt(q.Get("concurrency"), 10, 64)
-	if err != nil || concurrency64 <= 0 {
+	spec, files, err := decodeStart(r)
+	if err != nil {
 		w.WriteHeader(400)
-		w.Write([]byte("concurrency must be > 0"))
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	concurrency := int(concurrency64)
+	if spec.Feeder != nil {
+		if spec.Feeder.Mode == "" {
+			spec.Feeder.Mode = bench.FeederSequential
+		}
+
+		err = spec.Feeder.Validate()
+		if err == nil {
+			var rows []map[string]string
+
+			rows, err = bench.ParseRows(spec.Feeder.Format, files["feeder"])
+			if err == nil && len(rows) == 0 {
+				err = errors.New("feeder has no rows")
+			}
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if len(spec.Stages) > 0 {
+		err = bench.ValidateStages(spec.Stages)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	var concurrency int
+	var duration time.Duration
+
+	if len(spec.Stages) > 0 && !bench.StagesUseRate(spec.Stages) {
+		// A concurrency profile provisions for its peak.
+		concurrency = bench.StagesPeakConcurrency(spec.Stages)
+	} else {
+		concurrency64, err := strconv.ParseInt(q.Get("concurrency"), 10, 64)
+		if err != nil || concurrency64 <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("concurrency must be > 0"))
+			return
+		}
+
+		concurrency = int(concurrency64)
+	}
+
+	if len(spec.Stages) > 0 {
+		duration = bench.StagesDuration(spec.Stages)
+	} else {
+		duration, err = time.ParseDuration(q.Get("duration"))
+		if err != nil || duration <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("duration must be > 0"))
+			return
+		}
+	}
 
-	duration, err := time.ParseDuration(q.Get("duration"))
-	if err != nil || duration <= 0 {
+	var rate float64
+	if q.Get("rate") != "" {
+		rate, err = strconv.ParseFloat(q.Get("rate"), 64)
+		if err != nil || rate <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("rate must be > 0"))
+			return
+		}
+	}
+
+	interval := bench.DefaultInterval
+	if q.Get("interval") != "" {
+		interval, err = time.ParseDuration(q.Get("interval"))
+		if err != nil || interval <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("interval must be > 0"))
+			return
+		}
+	}
+
+	failurePolicy := q.Get("failurePolicy")
+	switch failurePolicy {
+	case "":
+		failurePolicy = bench.FailureContinue
+	case bench.FailureContinue, bench.FailureAbort:
+	default:
 		w.WriteHeader(400)
-		w.Write([]byte("duration must be > 0"))
+		w.Write([]byte("failurePolicy must be continue or abort"))
 		return
 	}
 
+	var retries int
+	if q.Get("retries") != "" {
+		retries, err = strconv.Atoi(q.Get("retries"))
+		if err != nil || retries < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("retries must be >= 0"))
+			return
+		}
+	}
+
+	var cancelInFlight bool
+	if q.Get("cancelInFlight") != "" {
+		cancelInFlight, err = strconv.ParseBool(q.Get("cancelInFlight"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("cancelInFlight must be a boolean"))
+			return
+		}
+	}
+
 	timeout, err := time.ParseDuration(q.Get("timeout"))
-	if err != nil || timeout <= 0 || timeout > 2*time.Second {
+	if err != nil || timeout <= 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("timeout must be > 0"))
+		return
+	}
+
+	err = spec.Histogram.Validate()
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	rateDriven := rate > 0 || bench.StagesUseRate(spec.Stages) || (spec.Replay != nil && spec.Replay.Speed > 0)
+
+	histogram := spec.Histogram.WithDefaults(bench.DefaultMax(timeout, duration, rateDriven))
+
+	rawURL := q.Get("url")
+
+	if spec.Request != nil {
+		if spec.Request.URL == "" {
+			spec.Request.URL = rawURL
+		}
+
+		spec.Request.Method = strings.ToUpper(spec.Request.Method)
+
+		err = spec.Request.Validate()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		rawURL = spec.Request.URL
+	}
+
+	_, err = bench.NewTemplateReplacer(spec.Generators)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if spec.Replay != nil {
+		err = spec.Replay.Validate()
+		if err == nil {
+			var entries []bench.LogEntry
+
+			entries, err = bench.ParseAccessLog(spec.Replay.Format, files["replay"])
+			if err == nil && len(entries) == 0 {
+				err = errors.New("access log has no requests")
+			}
+		}
+
+		if err == nil && spec.Replay.Speed > 0 && len(spec.Stages) > 0 {
+			err = errors.New("stages cannot be used with a timed replay")
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if rawURL == "" {
+			rawURL = spec.Replay.BaseURL
+		}
+	}
+
+	sources := 0
+	for _, set := range []bool{spec.Request != nil, spec.Scenario != nil, len(spec.Requests) > 0, spec.Replay != nil} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources > 1 {
 		w.WriteHeader(400)
-		w.Write([]byte("timeout must be > 0 and <= 2ms"))
+		w.Write([]byte("only one of request, requests, scenario or replay may be set"))
 		return
 	}
 
-	u, err := url.Parse(q.Get("url"))
+	if len(spec.Requests) > 0 {
+		for i := range spec.Requests {
+			spec.Requests[i].Method = strings.ToUpper(spec.Requests[i].Method)
+		}
+
+		err = bench.ValidateMix(spec.Requests)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if rawURL == "" {
+			rawURL = spec.Requests[0].URL
+		}
+	}
+
+	if spec.Scenario != nil {
+		for i := range spec.Scenario.Steps {
+			spec.Scenario.Steps[i].Method = strings.ToUpper(spec.Scenario.Steps[i].Method)
+		}
+
+		err = spec.Scenario.Validate()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if rawURL == "" {
+			rawURL = spec.Scenario.Steps[0].URL
+		}
+	}
+
+	u, err := url.Parse(rawURL)
 	if err != nil || !u.IsAbs() {
 		w.WriteHeader(400)
 		w.Write([]byte("url must be a valid absolute url"))
@@ -163,57 +598,251 @@ func start(w http.ResponseWriter, r *http.Request) {
 
 	j := bench.Job{
 		Concurrency: concurrency,
+		Rate:        rate,
 		Duration:    duration,
 		RequestTime: time.Now(),
 		RunID:       runID,
 		Timeout:     timeout,
 		URL:         u.String(),
+		Stages:      spec.Stages,
+		Request:     spec.Request,
+		Scenario:    spec.Scenario,
+		Requests:    spec.Requests,
+		Generators:  spec.Generators,
+		Feeder:      spec.Feeder,
+		Replay:      spec.Replay,
+		Histogram:   histogram,
+		Interval:    interval,
+		MetaData:    spec.MetaData,
+
+		CancelInFlight: cancelInFlight,
+		FailurePolicy:  failurePolicy,
+		Retries:        retries,
 	}
 
-	if r.Body != nil {
-		err = json.NewDecoder(r.Body).Decode(&j.MetaData)
-		if err != nil {
-			writeErr(w, errors.Wrap(err, "error decoding body"))
-			return
-		}
+	err = j.Transition(bench.StatePending, j.RequestTime)
+	if err != nil {
+		writeErr(w, err)
+		return
 	}
 
+	var shares []int
 	for i := concurrency; i > 0; i -= maxPerContainer {
 		c := maxPerContainer
 		if i < c {
 			c = i
 		}
 
+		shares = append(shares, c)
+	}
+
+	taskStages := splitStages(spec.Stages, shares)
+
+	// Uploaded files are saved before any runner starts, since runners
+	// download them on start up.
+	if spec.Feeder != nil {
+		err = sm.SaveData(runID, "feeder", files["feeder"])
+		if err != nil {
+			writeErr(w, errors.Wrap(err, "error saving feeder data"))
+			return
+		}
+	}
+
+	if spec.Replay != nil {
+		err = sm.SaveData(runID, "replay", files["replay"])
+		if err != nil {
+			writeErr(w, errors.Wrap(err, "error saving access log"))
+			return
+		}
+	}
+
+	// The job and each of its tasks are saved before the task's runner is
+	// launched, so a runner that comes up quickly finds its task.
+	err = sm.SaveJob(&j)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error saving job"))
+		return
+	}
+
+	for i, c := range shares {
+		// Each task gets the share of the rate matching its share of the
+		// concurrency.
+		taskRate := rate * float64(c) / float64(concurrency)
+
 		runnerID := uuid.New().String()
 
-		taskID, err := cm.StartContainer(map[string]string{
+		env := map[string]string{
 			"BENCH_CONCURRENCY": strconv.FormatInt(int64(c), 10),
+			"BENCH_RATE":        strconv.FormatFloat(taskRate, 'f', -1, 64),
 			"BENCH_URL":         u.String(),
 			"BENCH_DURATION":    duration.String(),
 			"BENCH_TIMEOUT":     timeout.String(),
+			"BENCH_INTERVAL":    interval.String(),
 			"BENCH_RUN_ID":      runID,
 			"BENCH_RUNNER_ID":   runnerID,
-		})
+			"BENCH_TASK_INDEX":  strconv.Itoa(i),
+			"BENCH_TASK_COUNT":  strconv.Itoa(len(shares)),
+		}
+
+		if cancelInFlight {
+			env["BENCH_CANCEL_IN_FLIGHT"] = "true"
+		}
+
+		if reportInterval > 0 {
+			env["BENCH_REPORT_INTERVAL"] = reportInterval.String()
+		}
 
+		histogramData, err := json.Marshal(histogram)
 		if err != nil {
-			writeErr(w, errors.Wrap(err, "error starting container"))
+			writeErr(w, errors.Wrap(err, "error marshalling histogram"))
 			return
 		}
 
-		j.Tasks = append(j.Tasks, bench.Task{
+		env["BENCH_HISTOGRAM"] = string(histogramData)
+
+		if spec.Request != nil {
+			requestData, err := json.Marshal(spec.Request)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling request"))
+				return
+			}
+
+			env["BENCH_REQUEST"] = string(requestData)
+		}
+
+		if spec.Scenario != nil {
+			scenarioData, err := json.Marshal(spec.Scenario)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling scenario"))
+				return
+			}
+
+			env["BENCH_SCENARIO"] = string(scenarioData)
+		}
+
+		if len(spec.Requests) > 0 {
+			requestsData, err := json.Marshal(spec.Requests)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling requests"))
+				return
+			}
+
+			env["BENCH_REQUESTS"] = string(requestsData)
+		}
+
+		if len(spec.Generators) > 0 {
+			generatorsData, err := json.Marshal(spec.Generators)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling generators"))
+				return
+			}
+
+			env["BENCH_GENERATORS"] = string(generatorsData)
+		}
+
+		if spec.Feeder != nil {
+			feederData, err := json.Marshal(spec.Feeder)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling feeder"))
+				return
+			}
+
+			env["BENCH_FEEDER"] = string(feederData)
+		}
+
+		if spec.Replay != nil {
+			replayData, err := json.Marshal(spec.Replay)
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling replay"))
+				return
+			}
+
+			env["BENCH_REPLAY"] = string(replayData)
+		}
+
+		if taskStages != nil {
+			stagesData, err := json.Marshal(taskStages[i])
+			if err != nil {
+				writeErr(w, errors.Wrap(err, "error marshalling stages"))
+				return
+			}
+
+			env["BENCH_STAGES"] = string(stagesData)
+		}
+
+		task := bench.Task{
 			ID:          runnerID,
-			ContainerID: taskID,
 			Concurrency: c,
-		})
+			Rate:        taskRate,
+			Env:         env,
+		}
+
+		if taskStages != nil {
+			task.Stages = taskStages[i]
+		}
+
+		err = task.Transition(bench.StatePending, j.RequestTime)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+
+		token, err := issueToken(&task)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+
+		err = sm.AddTask(runID, &task)
+		if err != nil {
+			writeErr(w, errors.Wrap(err, "error saving task"))
+			return
+		}
+
+		err = launch(runID, &task, token, env, time.Now())
+		if err != nil {
+			// The job fails so the runners already started stop waiting
+			// for it.
+			_, saveErr := sm.ModifyTask(runID, task.ID, func(t *bench.Task) error {
+				t.Error = err.Error()
+				return t.Transition(bench.StateFailed, time.Now())
+			})
+			if saveErr != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrap(saveErr, "error saving task")))
+			}
+
+			_, saveErr = modifyJob(runID, func(job *bench.Job) error {
+				return stopJob(job, bench.StateFailed, time.Now())
+			})
+			if saveErr != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrap(saveErr, "error saving job")))
+			}
+
+			writeErr(w, err)
+			return
+		}
 	}
 
-	err = sm.SaveJob(j)
+	// Runners may all be ready already, in which case the job starts now.
+	job, err := modifyJob(runID, func(job *bench.Job) error {
+		err := job.Transition(bench.StateProvisioning, time.Now())
+		if err != nil {
+			return err
+		}
+
+		err = sm.UpdateJob(job)
+		if err != nil {
+			return errors.Wrap(err, "error saving job")
+		}
+
+		return settle(job, time.Now())
+	})
 	if err != nil {
-		writeErr(w, errors.Wrap(err, "error saving job"))
+		writeSaveErr(w, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(&j)
+	json.NewEncoder(w).Encode(&job)
 }
 
 func readyToStart(w http.ResponseWriter, r *http.Request) {
@@ -228,15 +857,87 @@ func readyToStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task.Ready = true
+	if !authorizeTask(w, r, task) {
+		return
+	}
+
+	_, err = sm.ModifyTask(runID, runnerID, func(task *bench.Task) error {
+		task.Heartbeat = time.Now()
+
+		// The runner can be up before its launch is recorded.
+		if task.State == bench.StatePending {
+			err := task.Transition(bench.StateProvisioning, task.Heartbeat)
+			if err != nil {
+				return err
+			}
+		}
+
+		return task.Transition(bench.StateReady, task.Heartbeat)
+	})
+	if err != nil {
+		writeSaveErr(w, errors.Wrap(err, "error saving task"))
+		return
+	}
+
+	publishTask(runID, runnerID, eventReady, nil)
+
+	// The last task to become ready starts the job.
+	_, err = modifyJob(runID, func(job *bench.Job) error {
+		return settle(job, time.Now())
+	})
+	if err != nil {
+		writeSaveErr(w, err)
+		return
+	}
+}
+
+// heartbeat records that a runner is still alive. It answers 410 once the
+// task has ended, such as when the job was cancelled, so the runner stops.
+func heartbeat(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("runId")
+	runnerID := r.URL.Query().Get("runnerId")
+
+	task, err := sm.GetTask(runID, runnerID)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error getting task"))
+		return
+	}
+
+	if !authorizeTask(w, r, task) {
+		return
+	}
+
+	// The state is read inside the change, since the task returned when the
+	// change is stopped may not be the saved one.
+	var state bench.State
+
+	_, err = sm.ModifyTask(runID, runnerID, func(task *bench.Task) error {
+		state = task.State
+
+		if task.State.Terminal() && task.State != bench.StateCompleted {
+			return errTaskEnded
+		}
+
+		task.Heartbeat = time.Now()
+
+		return nil
+	})
+	if err == errTaskEnded {
+		w.WriteHeader(410)
+		w.Write([]byte(fmt.Sprintf("task is %s", state)))
+		return
+	}
 
-	err = sm.SaveTask(runID, task)
 	if err != nil {
-		writeErr(w, errors.Wrap(err, "error saving task"))
+		writeSaveErr(w, errors.Wrap(err, "error saving task"))
 		return
 	}
 }
 
+// errTaskEnded stops a change to a task that was cancelled or failed, telling
+// its runner to stop with a 410.
+var errTaskEnded = errors.New("task ended")
+
 func waitForStart(w http.ResponseWriter, r *http.Request) {
 	log.Println("waitForStart")
 
@@ -248,19 +949,103 @@ func waitForStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ready := true
-	for _, task := range job.Tasks {
-		ready = ready && task.Ready
+	// Runners give up on a job that ended before it started.
+	if job.State.Terminal() {
+		w.WriteHeader(410)
+		w.Write([]byte(fmt.Sprintf("job is %s", job.State)))
+		return
+	}
+
+	// The server time lets runners correct for the offset of their clocks
+	// when waiting for the start time.
+	output := startSchedule{ServerTime: time.Now()}
+
+	if job.State != bench.StateRunning && job.State != bench.StateReporting {
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(&output)
+		return
+	}
+
+	output.StartAt = job.StartTime
+
+	json.NewEncoder(w).Encode(&output)
+}
+
+// startSchedule is the body returned by /waitForStart. StartAt is unset until
+// every task is ready.
+type startSchedule struct {
+	StartAt    time.Time `json:"startAt,omitempty"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// reportProgress stores the cumulative result a runner has collected so far,
+// so /result can show a running job and a runner that dies mid-run does not
+// lose everything.
+func reportProgress(w http.ResponseWriter, r *http.Request) {
+	log.Println("reportProgress")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+
+	runID := r.URL.Query().Get("runId")
+	runnerID := r.URL.Query().Get("runnerId")
+
+	task, err := sm.GetTask(runID, runnerID)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error getting task"))
+		return
+	}
+
+	if !authorizeTask(w, r, task) {
+		return
+	}
+
+	var result bench.Result
+	err = json.NewDecoder(r.Body).Decode(&result)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error decoding body"))
+		return
+	}
+
+	_, err = sm.ModifyTask(runID, runnerID, func(task *bench.Task) error {
+		// Tell the runner to stop if its task was cancelled or failed; it
+		// still reports what it has so far.
+		if task.State.Terminal() && task.State != bench.StateCompleted {
+			return errTaskEnded
+		}
+
+		// Progress that arrives after the final result is stale.
+		if task.State.Terminal() {
+			return errStaleProgress
+		}
+
+		task.Progress = &result
+		task.ProgressTime = time.Now()
+		task.Heartbeat = task.ProgressTime
+
+		return task.Transition(bench.StateReporting, task.ProgressTime)
+	})
+	if err == errTaskEnded {
+		w.WriteHeader(410)
+		return
+	}
+
+	if err == errStaleProgress {
+		return
 	}
 
-	if ready {
-		w.WriteHeader(200)
+	if err != nil {
+		writeSaveErr(w, errors.Wrap(err, "error saving task"))
 		return
 	}
 
-	w.WriteHeader(202)
+	publishTask(runID, runnerID, eventProgress, nil)
 }
 
+var errStaleProgress = errors.New("progress after the result")
+
 func reportResult(w http.ResponseWriter, r *http.Request) {
 	log.Println("reportResult")
 
@@ -278,75 +1063,237 @@ func reportResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authorizeTask(w, r, task) {
+		return
+	}
+
 	var result bench.Result
 	err = json.NewDecoder(r.Body).Decode(&result)
 	if err != nil {
-		writeErr(w, errors.Wrap(err, "error decoding body"))
+		err = errors.Wrap(err, "error decoding body")
+		publishTask(runID, runnerID, eventFailed, err)
+		writeErr(w, err)
+		return
+	}
+
+	_, err = sm.ModifyTask(runID, runnerID, func(task *bench.Task) error {
+		task.Result = &result
+		task.Heartbeat = time.Now()
+
+		// A cancelled task stays cancelled, but its partial result is kept.
+		if task.State == bench.StateCancelled {
+			return nil
+		}
+
+		return task.Transition(bench.StateCompleted, task.Heartbeat)
+	})
+	if err != nil {
+		writeSaveErr(w, errors.Wrap(err, "error saving task"))
+		return
+	}
+
+	publishTask(runID, runnerID, eventReported, nil)
+
+	_, err = modifyJob(runID, func(job *bench.Job) error {
+		return settle(job, time.Now())
+	})
+	if err != nil {
+		writeSaveErr(w, err)
+		return
+	}
+}
+
+// cancel stops a job. Its tasks are marked cancelled and their containers
+// stopped; runners that are already running report the partial result they
+// have before they exit.
+func cancel(w http.ResponseWriter, r *http.Request) {
+	log.Println("cancel")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
 		return
 	}
 
-	task.Result = &result
+	runID := r.URL.Query().Get("runId")
+
+	job, err := modifyJob(runID, func(job *bench.Job) error {
+		if job.State.Terminal() {
+			return errors.Wrapf(bench.ErrInvalidTransition, "job is %s", job.State)
+		}
 
-	err = sm.SaveTask(runID, task)
+		return stopJob(job, bench.StateCancelled, time.Now())
+	})
 	if err != nil {
-		writeErr(w, errors.Wrap(err, "error saving task"))
+		writeSaveErr(w, err)
 		return
 	}
+
+	json.NewEncoder(w).Encode(&job)
 }
 
 func result(w http.ResponseWriter, r *http.Request) {
 	log.Println("result")
 
-	runID := r.URL.Query().Get("runId")
+	output, err := loadResult(r.URL.Query().Get("runId"))
+	if errors.Cause(err) == bench.ErrHistogramMismatch {
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	job, err := sm.GetJob(runID)
 	if err != nil {
-		writeErr(w, errors.Wrap(err, "error getting job"))
+		writeErr(w, err)
 		return
 	}
 
-	h := hdrhistogram.New(0, int64(hundredMicroSeconds(job.Timeout)), 2)
+	json.NewEncoder(w).Encode(&output)
+}
+
+// loadResult returns the merged result of the job. A retired job has its
+// compacted result, which outlives its tasks.
+func loadResult(runID string) (jobResult, error) {
+	var output jobResult
+
+	summary, err := sm.GetSummary(runID)
+	if err == nil {
+		err = json.Unmarshal(summary, &output)
+		return output, errors.Wrap(err, "error unmarshalling summary")
+	}
 
-	result := bench.Result{
-		StatusCodes: map[int]int{},
+	job, err := sm.GetJob(runID)
+	if err != nil {
+		return output, errors.Wrap(err, "error getting job")
 	}
 
+	return aggregate(job)
+}
+
+// jobResult is the merged result of a job, as returned by /result and pushed
+// by /stream.
+type jobResult struct {
+	Complete  bool               `json:"complete"`
+	Progress  progress           `json:"progress"`
+	Job       bench.Job          `json:"job"`
+	Summary   summary            `json:"summary"`
+	Phases    map[string]summary `json:"phases"`
+	Intervals []intervalSummary  `json:"intervals"`
+	Result    bench.Result       `json:"result"`
+}
+
+// aggregate merges the results reported by the tasks of job, using the
+// interim results of tasks that are still running.
+func aggregate(job bench.Job) (jobResult, error) {
+	// Jobs saved before histograms were configurable get the old defaults.
+	histogram := job.Histogram.WithDefaults(job.Timeout)
+
+	result := bench.NewResult(histogram)
+
 	complete := true
 
+	var p progress
+
 	for _, task := range job.Tasks {
-		if task.Result == nil {
-			complete = false
+		// A replaced task never ran; its replacement reports instead.
+		if task.ReplacedBy != "" {
 			continue
 		}
 
-		current := task.Result
+		p.Tasks++
 
-		currentH := hdrhistogram.Import(current.Histogram)
-		h.Merge(currentH)
+		taskResult := task.Result
 
-		result.Requests += current.Requests
-		result.Timeouts += current.Timeouts
-		result.Errors += current.Errors
+		switch {
+		case task.Result != nil:
+			p.Reported++
+		case task.Progress != nil:
+			// Tasks still running contribute what they have reported so far.
+			complete = false
+			p.Running++
+			taskResult = task.Progress
+		default:
+			complete = false
+			continue
+		}
 
-		for k, v := range current.StatusCodes {
-			result.StatusCodes[k] += v
+		err := result.Merge(*taskResult)
+		if err != nil {
+			return jobResult{}, errors.Wrapf(err, "task %s", task.ID)
 		}
 	}
 
+	p.measure(result.StartTime, job.Duration, complete)
+
+	// A job that ended early never gets the rest of its results.
+	complete = complete || job.State.Terminal()
+
+	h := result.Hist()
 	result.Histogram = h.Export()
 
-	type summary struct {
-		Max                   int64                  `json:"max"`
-		Min                   int64                  `json:"min"`
-		Mean                  float64                `json:"mean"`
-		StdDev                float64                `json:"stddev"`
-		TotalCount            int64                  `json:"totalCount"`
-		HighestTrackableValue int64                  `json:"highestTrackableValue"`
-		LowestTrackableValue  int64                  `json:"lowestTrackableValue"`
-		Brackets              []hdrhistogram.Bracket `json:"brackets"`
+	phases := map[string]summary{}
+	for _, phase := range bench.Phases {
+		if ph := result.PhaseHist(phase); ph != nil {
+			phases[phase] = summarize(ph, histogram.Resolution)
+		}
+	}
+
+	return jobResult{
+		Complete:  complete,
+		Progress:  p,
+		Job:       job,
+		Summary:   summarize(h, histogram.Resolution),
+		Phases:    phases,
+		Intervals: summarizeIntervals(result.Intervals),
+		Result:    result,
+	}, nil
+}
+
+// progress tells how far along a job is. Tasks are counted as reported once
+// their final result is in, and as running while they send interim results.
+type progress struct {
+	Tasks    int           `json:"tasks"`
+	Reported int           `json:"reported"`
+	Running  int           `json:"running"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Percent  float64       `json:"percent"`
+}
+
+// measure sets the time elapsed since the first runner started, capped at the
+// job duration.
+func (p *progress) measure(start time.Time, duration time.Duration, complete bool) {
+	if complete {
+		p.Elapsed = duration
+		p.Percent = 100
+		return
+	}
+
+	if start.IsZero() || duration <= 0 {
+		return
+	}
+
+	p.Elapsed = time.Since(start)
+	if p.Elapsed > duration {
+		p.Elapsed = duration
 	}
 
-	s := summary{
+	p.Percent = 100 * float64(p.Elapsed) / float64(duration)
+}
+
+// summary describes a latency histogram. Values are in units of Resolution.
+type summary struct {
+	Resolution            time.Duration          `json:"resolution"`
+	Max                   int64                  `json:"max"`
+	Min                   int64                  `json:"min"`
+	Mean                  float64                `json:"mean"`
+	StdDev                float64                `json:"stddev"`
+	TotalCount            int64                  `json:"totalCount"`
+	HighestTrackableValue int64                  `json:"highestTrackableValue"`
+	LowestTrackableValue  int64                  `json:"lowestTrackableValue"`
+	Brackets              []hdrhistogram.Bracket `json:"brackets"`
+}
+
+func summarize(h *hdrhistogram.Histogram, resolution time.Duration) summary {
+	return summary{
+		Resolution:            resolution,
 		Max:                   h.Max(),
 		Min:                   h.Min(),
 		Mean:                  h.Mean(),
@@ -356,20 +1303,73 @@ func result(w http.ResponseWriter, r *http.Request) {
 		LowestTrackableValue:  h.LowestTrackableValue(),
 		Brackets:              h.CumulativeDistribution(),
 	}
+}
+
+// intervalSummary is one point of the throughput and latency time series.
+// Latencies are in units of the histogram resolution.
+type intervalSummary struct {
+	Time              time.Time `json:"time"`
+	Requests          int       `json:"requests"`
+	Errors            int       `json:"errors"`
+	Timeouts          int       `json:"timeouts"`
+	RequestsPerSecond float64   `json:"requestsPerSecond"`
+	P50               int64     `json:"p50"`
+	P90               int64     `json:"p90"`
+	P99               int64     `json:"p99"`
+	Max               int64     `json:"max"`
+}
+
+func summarizeIntervals(intervals []bench.Result) []intervalSummary {
+	series := []intervalSummary{}
+
+	for _, interval := range intervals {
+		s := intervalSummary{
+			Time:     interval.StartTime,
+			Requests: interval.Requests,
+			Errors:   interval.Errors,
+			Timeouts: interval.Timeouts,
+		}
+
+		if interval.Time > 0 {
+			s.RequestsPerSecond = float64(interval.Requests) / interval.Time.Seconds()
+		}
+
+		if h := interval.Hist(); h != nil {
+			s.P50 = h.ValueAtQuantile(50)
+			s.P90 = h.ValueAtQuantile(90)
+			s.P99 = h.ValueAtQuantile(99)
+			s.Max = h.Max()
+		}
 
-	output := struct {
-		Complete bool         `json:"complete"`
-		Job      bench.Job    `json:"job"`
-		Summary  summary      `json:"summary"`
-		Result   bench.Result `json:"result"`
-	}{
-		Complete: complete,
-		Job:      job,
-		Summary:  s,
-		Result:   result,
+		series = append(series, s)
 	}
 
-	json.NewEncoder(w).Encode(&output)
+	return series
+}
+
+func data(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("runId")
+	name := r.URL.Query().Get("name")
+
+	log.Println("data", runID, name)
+
+	task, err := sm.GetTask(runID, r.URL.Query().Get("runnerId"))
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error getting task"))
+		return
+	}
+
+	if !authorizeTask(w, r, task) {
+		return
+	}
+
+	data, err := sm.GetData(runID, name)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error getting data"))
+		return
+	}
+
+	w.Write(data)
 }
 
 func logs(w http.ResponseWriter, r *http.Request) {
@@ -405,7 +1405,120 @@ func tasks(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&j.Tasks)
 }
 
-func hundredMicroSeconds(d time.Duration) int {
-	us := int(d / time.Microsecond)
-	return int(math.Round(float64(us / 100)))
+// Page sizes of /jobs.
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 1000
+)
+
+// jobs lists jobs newest first, without their tasks. It filters on the url,
+// state, from and to (RFC 3339 times bounding the request time) query
+// parameters, and on meta data with meta.<key>=<value>, and pages with offset
+// and limit.
+func jobs(w http.ResponseWriter, r *http.Request) {
+	log.Println("jobs")
+
+	q := r.URL.Query()
+
+	query := storage.JobQuery{
+		URL:   q.Get("url"),
+		State: bench.State(q.Get("state")),
+		Meta:  map[string]string{},
+		Limit: defaultJobsLimit,
+	}
+
+	var err error
+
+	for name, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if q.Get(name) == "" {
+			continue
+		}
+
+		*t, err = time.Parse(time.RFC3339, q.Get(name))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(name + " must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	if q.Get("offset") != "" {
+		query.Offset, err = strconv.Atoi(q.Get("offset"))
+		if err != nil || query.Offset < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("offset must be >= 0"))
+			return
+		}
+	}
+
+	if q.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || query.Limit <= 0 || query.Limit > maxJobsLimit {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("limit must be > 0 and <= %d", maxJobsLimit)))
+			return
+		}
+	}
+
+	for name := range q {
+		if strings.HasPrefix(name, "meta.") {
+			query.Meta[strings.TrimPrefix(name, "meta.")] = q.Get(name)
+		}
+	}
+
+	list, err := sm.ListJobs(query)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error listing jobs"))
+		return
+	}
+
+	json.NewEncoder(w).Encode(&jobList{
+		JobList: list,
+		Offset:  query.Offset,
+		Limit:   query.Limit,
+	})
+}
+
+type jobList struct {
+	storage.JobList
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// splitStages divides every stage of a profile between tasks in proportion to
+// their share of the concurrency. Concurrency is split so the tasks always add
+// up to the stage target.
+func splitStages(stages []bench.Stage, shares []int) [][]bench.Stage {
+	if len(stages) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, c := range shares {
+		total += c
+	}
+
+	split := make([][]bench.Stage, len(shares))
+
+	for _, s := range stages {
+		assigned := 0
+
+		for i, c := range shares {
+			taskStage := s
+			taskStage.Rate = s.Rate * float64(c) / float64(total)
+
+			// The last task takes whatever rounding left over.
+			if i == len(shares)-1 {
+				taskStage.Concurrency = s.Concurrency - assigned
+			} else {
+				taskStage.Concurrency = s.Concurrency * c / total
+			}
+
+			assigned += taskStage.Concurrency
+
+			split[i] = append(split[i], taskStage)
+		}
+	}
+
+	return split
 }
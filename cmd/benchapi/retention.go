@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+	"github.com/rickbassham/bench/storage"
+)
+
+// Archiver keeps the records of finished jobs outside of the storage, before
+// they expire from it.
+type Archiver interface {
+	Put(key string, data []byte) error
+}
+
+var (
+	// retention is how long the records of a job are kept once it is
+	// retired.
+	retention storage.Retention
+	// archiver is where retired jobs are archived, or nil if they are not.
+	archiver Archiver
+)
+
+// dataEnv maps the names of the data files a job may have to the variable set
+// on its tasks when it does.
+var dataEnv = map[string]string{
+	"feeder": "BENCH_FEEDER",
+	"replay": "BENCH_REPLAY",
+}
+
+// retireJobs retires the jobs that ended long enough ago that no more results
+// will come in, and then purges the records that have expired.
+func retireJobs(now time.Time) {
+	runIDs, err := sm.EndedJobs(now.Add(-resultGrace))
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+		return
+	}
+
+	for _, runID := range runIDs {
+		err = retire(runID)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrapf(err, "error retiring job %s", runID)))
+		}
+	}
+
+	err = sm.Purge(now)
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+	}
+}
+
+// retire archives the job and its merged result, if there is an archiver, and
+// saves the result compacted so it outlives the raw results of its tasks.
+func retire(runID string) error {
+	job, err := sm.GetJob(runID)
+	if err != nil {
+		return errors.Wrap(err, "error getting job")
+	}
+
+	output, err := aggregate(job)
+	if err != nil {
+		return err
+	}
+
+	if archiver != nil {
+		err = archiveJob(job, output)
+		if err != nil {
+			return err
+		}
+	}
+
+	summary, err := json.Marshal(compact(output))
+	if err != nil {
+		return errors.Wrap(err, "error marshalling summary")
+	}
+
+	return sm.RetireJob(runID, summary, retention)
+}
+
+// archiveJob puts the job, its merged result and its data files under its run
+// ID.
+func archiveJob(job bench.Job, output jobResult) error {
+	jobData, err := json.Marshal(&job)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling job")
+	}
+
+	resultData, err := json.Marshal(&output)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling result")
+	}
+
+	err = archiver.Put(job.RunID+"/job.json", jobData)
+	if err != nil {
+		return errors.Wrap(err, "error archiving job")
+	}
+
+	err = archiver.Put(job.RunID+"/result.json", resultData)
+	if err != nil {
+		return errors.Wrap(err, "error archiving result")
+	}
+
+	for name, env := range dataEnv {
+		if len(job.Tasks) == 0 || job.Tasks[0].Env[env] == "" {
+			continue
+		}
+
+		data, err := sm.GetData(job.RunID, name)
+		if err != nil {
+			return errors.Wrapf(err, "error getting %s data", name)
+		}
+
+		err = archiver.Put(job.RunID+"/"+name, data)
+		if err != nil {
+			return errors.Wrapf(err, "error archiving %s data", name)
+		}
+	}
+
+	return nil
+}
+
+// compact strips the raw results, logs and secrets from the tasks of output,
+// keeping the merged result.
+func compact(output jobResult) jobResult {
+	tasks := make([]bench.Task, len(output.Job.Tasks))
+
+	for i, task := range output.Job.Tasks {
+		task.Result = nil
+		task.Progress = nil
+		task.Logs = ""
+		task.Env = nil
+		task.TokenHash = ""
+
+		tasks[i] = task
+	}
+
+	output.Job.Tasks = tasks
+
+	return output
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Task lifecycle events pushed by /stream. eventRunning and eventCancelled
+// have no task, as they are about the whole job.
+const (
+	eventStarted   = "started"
+	eventReady     = "ready"
+	eventRunning   = "running"
+	eventProgress  = "progress"
+	eventReported  = "reported"
+	eventFailed    = "failed"
+	eventCancelled = "cancelled"
+)
+
+// taskEvent is sent when a task of a job changes. TaskID is empty for events
+// about the whole job, such as every task being ready and the run starting.
+type taskEvent struct {
+	Event  string    `json:"event"`
+	TaskID string    `json:"taskId,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// streamEvent is a single server-sent event.
+type streamEvent struct {
+	name string
+	data interface{}
+}
+
+// broker fans events for a job out to the clients streaming it. Clients that
+// fall behind miss events rather than holding up the handlers publishing
+// them, so streams look for the end of the job themselves too.
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan streamEvent]struct{}
+}
+
+var events = &broker{subs: map[string]map[chan streamEvent]struct{}{}}
+
+func (b *broker) subscribe(runID string) chan streamEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan streamEvent, 16)
+
+	if b.subs[runID] == nil {
+		b.subs[runID] = map[chan streamEvent]struct{}{}
+	}
+
+	b.subs[runID][ch] = struct{}{}
+
+	return ch
+}
+
+func (b *broker) unsubscribe(runID string, ch chan streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs[runID], ch)
+
+	if len(b.subs[runID]) == 0 {
+		delete(b.subs, runID)
+	}
+}
+
+// watched reports whether anyone is streaming the job, so handlers can skip
+// building events nobody will see.
+func (b *broker) watched(runID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs[runID]) > 0
+}
+
+func (b *broker) publish(runID string, ev streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[runID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishTask sends a lifecycle event for a task, followed by the merged
+// result of the job when the event changes it. A job that is cancelled or
+// fails may never hear from its runners again, so those events are followed
+// by the result too, which lets streams of the job end.
+func publishTask(runID, taskID, event string, err error) {
+	if !events.watched(runID) {
+		return
+	}
+
+	ev := taskEvent{
+		Event:  event,
+		TaskID: taskID,
+		Time:   time.Now(),
+	}
+
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	events.publish(runID, streamEvent{name: "task", data: ev})
+
+	switch event {
+	case eventProgress, eventReported, eventFailed, eventCancelled:
+		publishResult(runID)
+	}
+}
+
+// publishResult sends the merged result of the job.
+func publishResult(runID string) {
+	if !events.watched(runID) {
+		return
+	}
+
+	job, err := sm.GetJob(runID)
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error getting job")))
+		return
+	}
+
+	output, err := aggregate(job)
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+		return
+	}
+
+	events.publish(runID, streamEvent{name: "result", data: output})
+}
+
+// streamKeepAlive is how often a comment is sent on an idle stream, so
+// proxies do not close it.
+const streamKeepAlive = 15 * time.Second
+
+// stream pushes the events of a job as server-sent events: "task" for task
+// lifecycle changes and "result" for the merged result whenever a task
+// reports. The current result is sent as soon as the client connects, and
+// the stream ends once every task has reported or the job has ended.
+func stream(w http.ResponseWriter, r *http.Request) {
+	runID := r.URL.Query().Get("runId")
+
+	log.Println("stream", runID)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, errors.New("streaming is not supported"))
+		return
+	}
+
+	// Subscribe before reading the job, so nothing that happens in between
+	// is missed.
+	ch := events.subscribe(runID)
+	defer events.unsubscribe(runID, ch)
+
+	job, err := sm.GetJob(runID)
+	if err != nil {
+		writeErr(w, errors.Wrap(err, "error getting job"))
+		return
+	}
+
+	output, err := aggregate(job)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	err = writeEvent(w, streamEvent{name: "result", data: output})
+	if err != nil {
+		return
+	}
+
+	flusher.Flush()
+
+	complete := output.Complete || output.Job.State.Terminal()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for !complete {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			// The event ending the job may have been missed.
+			output, complete, err = ended(runID)
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", err))
+				return
+			}
+
+			if complete {
+				err = writeEvent(w, streamEvent{name: "result", data: output})
+			} else {
+				_, err = w.Write([]byte(": keepalive\n\n"))
+			}
+		case ev := <-ch:
+			err = writeEvent(w, ev)
+
+			if output, ok := ev.data.(jobResult); ok {
+				complete = output.Complete || output.Job.State.Terminal()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// ended reports whether the job has ended, with its merged result if it has.
+func ended(runID string) (jobResult, bool, error) {
+	job, err := sm.GetJob(runID)
+	if err != nil {
+		return jobResult{}, false, errors.Wrap(err, "error getting job")
+	}
+
+	if !job.State.Terminal() {
+		return jobResult{}, false, nil
+	}
+
+	output, err := aggregate(job)
+	if err != nil {
+		return jobResult{}, false, err
+	}
+
+	return output, true, nil
+}
+
+func writeEvent(w http.ResponseWriter, ev streamEvent) error {
+	data, err := json.Marshal(ev.data)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling event")
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, data)
+	if err != nil {
+		return errors.Wrap(err, "error writing event")
+	}
+
+	return nil
+}
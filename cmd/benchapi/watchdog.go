@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+	"github.com/rickbassham/bench/storage"
+)
+
+// Deadlines enforced by the watchdog.
+var (
+	// readyTimeout is how long a task has to become ready once it is
+	// launched.
+	readyTimeout time.Duration
+	// heartbeatTimeout is how long a runner may go without being heard from
+	// once it is up.
+	heartbeatTimeout time.Duration
+	// resultGrace is how long after the end of a job its results may take to
+	// come in.
+	resultGrace time.Duration
+)
+
+// watchdog checks the active jobs every interval, failing the tasks that
+// missed a deadline so the job can carry on without them or end, and then
+// retires the jobs that have ended.
+func watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runIDs, err := sm.ActiveJobs()
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", err))
+			continue
+		}
+
+		for _, runID := range runIDs {
+			job, err := sm.GetJob(runID)
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error getting job")))
+				continue
+			}
+
+			err = reconcile(&job, time.Now())
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrapf(err, "error checking job %s", runID)))
+			}
+		}
+
+		retireJobs(time.Now())
+	}
+}
+
+// reconcile fails the tasks of job that missed a deadline, replacing them if
+// the job has not started and has retries left, and then settles the job.
+func reconcile(job *bench.Job, now time.Time) error {
+	if job.State.Terminal() {
+		return nil
+	}
+
+	// Replacements are appended while looping, and are checked next time.
+	for i, n := 0, len(job.Tasks); i < n; i++ {
+		task := &job.Tasks[i]
+
+		if task.State.Terminal() || task.ReplacedBy != "" {
+			continue
+		}
+
+		if state, _ := overdue(*job, *task, now); state == "" {
+			continue
+		}
+
+		// The runner may have been heard from since the job was read.
+		var reason string
+
+		saved, err := sm.ModifyTask(job.RunID, task.ID, func(task *bench.Task) error {
+			var state bench.State
+
+			state, reason = overdue(*job, *task, now)
+			if state == "" || task.State.Terminal() {
+				return errUnchanged
+			}
+
+			task.Error = reason
+
+			return task.Transition(state, now)
+		})
+		if err == errUnchanged {
+			*task = saved
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error saving task")
+		}
+
+		*task = saved
+
+		log.Println("task", task.ID, reason)
+
+		publishTask(job.RunID, task.ID, eventFailed, errors.New(reason))
+
+		stopContainers(*task)
+
+		if job.State == bench.StateProvisioning && task.Attempt < job.Retries && task.Env != nil {
+			err = relaunch(job, i, now)
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrapf(err, "error replacing task %s", task.ID)))
+			}
+		}
+	}
+
+	return settle(job, now)
+}
+
+// errUnchanged stops a change to a task that no longer needs it.
+var errUnchanged = errors.New("unchanged")
+
+// overdue returns the state a task that missed a deadline ends in and why, or
+// an empty state if it is on time.
+func overdue(job bench.Job, task bench.Task, now time.Time) (bench.State, string) {
+	switch task.State {
+	case bench.StatePending, bench.StateProvisioning:
+		if now.Sub(task.Since()) > readyTimeout {
+			return bench.StateTimedOut, fmt.Sprintf("not ready within %s", readyTimeout)
+		}
+
+		return "", ""
+	}
+
+	heartbeat := task.Heartbeat
+	if heartbeat.IsZero() {
+		heartbeat = task.Since()
+	}
+
+	if now.Sub(heartbeat) > heartbeatTimeout {
+		return bench.StateFailed, fmt.Sprintf("no heartbeat for %s", now.Sub(heartbeat).Round(time.Second))
+	}
+
+	if !job.StartTime.IsZero() && now.After(job.StartTime.Add(job.Duration+resultGrace)) {
+		return bench.StateTimedOut, fmt.Sprintf("no result within %s of the end of the job", resultGrace)
+	}
+
+	return "", ""
+}
+
+// relaunch starts a replacement for the i-th task of job, which takes over its
+// share of the load.
+func relaunch(job *bench.Job, i int, now time.Time) error {
+	old := &job.Tasks[i]
+
+	task := bench.Task{
+		ID:          uuid.New().String(),
+		Concurrency: old.Concurrency,
+		Rate:        old.Rate,
+		Stages:      old.Stages,
+		Attempt:     old.Attempt + 1,
+		Env:         map[string]string{},
+	}
+
+	for k, v := range old.Env {
+		task.Env[k] = v
+	}
+
+	task.Env["BENCH_RUNNER_ID"] = task.ID
+
+	err := task.Transition(bench.StatePending, now)
+	if err != nil {
+		return err
+	}
+
+	token, err := issueToken(&task)
+	if err != nil {
+		return err
+	}
+
+	// The task is saved before its container is started, so its runner
+	// finds it.
+	err = sm.AddTask(job.RunID, &task)
+	if err != nil {
+		return errors.Wrap(err, "error saving task")
+	}
+
+	job.Tasks = append(job.Tasks, task)
+
+	// job.Tasks may have moved, so old is looked up again.
+	old = &job.Tasks[i]
+
+	// A task that fails to launch stays pending until it times out.
+	err = launch(job.RunID, &job.Tasks[len(job.Tasks)-1], token, task.Env, now)
+	if err != nil {
+		return err
+	}
+
+	*old, err = sm.ModifyTask(job.RunID, old.ID, func(t *bench.Task) error {
+		t.ReplacedBy = task.ID
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error saving task")
+	}
+
+	return nil
+}
+
+// settle moves job on after one of its tasks changed: it starts once every
+// remaining task is ready, fails if a task failed under FailureAbort, and
+// ends once every task has. Replaced tasks are left out.
+func settle(job *bench.Job, now time.Time) error {
+	if job.State.Terminal() {
+		return nil
+	}
+
+	// A pending job is still being launched by start, which settles it once
+	// every task is, unless start died before it could.
+	if job.State == bench.StatePending && now.Sub(job.RequestTime) < readyTimeout {
+		return nil
+	}
+
+	var live, ready, completed, failed int
+
+	for _, task := range job.Tasks {
+		switch {
+		case task.ReplacedBy != "":
+		case task.State == bench.StateCompleted:
+			completed++
+		case task.State.Terminal():
+			failed++
+		case task.State == bench.StateReady:
+			ready++
+			live++
+		default:
+			live++
+		}
+	}
+
+	if failed > 0 && job.FailurePolicy == bench.FailureAbort {
+		return stopJob(job, bench.StateFailed, now)
+	}
+
+	state := job.State
+
+	switch {
+	case live == 0 && completed > 0:
+		state = bench.StateCompleted
+	case live == 0:
+		state = bench.StateFailed
+	case job.State == bench.StateProvisioning && ready == live:
+		return startJob(job, now)
+	case job.State == bench.StateRunning && completed > 0:
+		state = bench.StateReporting
+	}
+
+	if state == job.State {
+		return nil
+	}
+
+	err := job.Transition(state, now)
+	if err != nil {
+		return err
+	}
+
+	err = sm.UpdateJob(job)
+	if err != nil {
+		return errors.Wrap(err, "error saving job")
+	}
+
+	// The last task to end may not have reported, so nothing else tells
+	// streams of the job that it is over.
+	if job.State.Terminal() {
+		publishResult(job.RunID)
+	}
+
+	return nil
+}
+
+// startDelay is how long after every task is ready the job starts. Runners
+// poll /waitForStart, so it must leave all of them time to hear of the start.
+var startDelay time.Duration
+
+// startJob runs a job whose remaining tasks are all ready. The job runs from
+// a common start time in the near future, which runners wait for. The job is
+// saved first, so it can be tried again from scratch if it changed.
+func startJob(job *bench.Job, now time.Time) error {
+	startAt := now.Add(startDelay)
+
+	err := job.Transition(bench.StateReady, now)
+	if err == nil {
+		err = job.Transition(bench.StateRunning, startAt)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = sm.UpdateJob(job)
+	if err != nil {
+		return errors.Wrap(err, "error saving job")
+	}
+
+	for i := range job.Tasks {
+		task := &job.Tasks[i]
+
+		if task.State != bench.StateReady || task.ReplacedBy != "" {
+			continue
+		}
+
+		*task, err = sm.ModifyTask(job.RunID, task.ID, func(t *bench.Task) error {
+			if t.State != bench.StateReady {
+				return errUnchanged
+			}
+
+			return t.Transition(bench.StateRunning, startAt)
+		})
+		if err != nil && err != errUnchanged {
+			return errors.Wrap(err, "error saving task")
+		}
+	}
+
+	publishTask(job.RunID, "", eventRunning, nil)
+
+	return nil
+}
+
+// stopJob ends job in state, cancelling its tasks and stopping their
+// containers. Runners that are already running report the partial result
+// they have before they exit. The job is saved first, like in startJob.
+func stopJob(job *bench.Job, state bench.State, now time.Time) error {
+	err := job.Transition(state, now)
+	if err != nil {
+		return err
+	}
+
+	err = sm.UpdateJob(job)
+	if err != nil {
+		return errors.Wrap(err, "error saving job")
+	}
+
+	var stopped []bench.Task
+
+	for i := range job.Tasks {
+		task := &job.Tasks[i]
+
+		if task.State.Terminal() || task.ReplacedBy != "" {
+			continue
+		}
+
+		*task, err = sm.ModifyTask(job.RunID, task.ID, func(t *bench.Task) error {
+			if t.State.Terminal() {
+				return errUnchanged
+			}
+
+			return t.Transition(bench.StateCancelled, now)
+		})
+		if err == errUnchanged {
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error saving task")
+		}
+
+		stopped = append(stopped, *task)
+	}
+
+	event := eventCancelled
+	if state == bench.StateFailed {
+		event = eventFailed
+	}
+
+	publishTask(job.RunID, "", event, nil)
+
+	stopContainers(stopped...)
+
+	return nil
+}
+
+// modifyJobAttempts is how many times modifyJob tries to change a job before
+// giving up on a conflict.
+const modifyJobAttempts = 5
+
+// modifyJob applies f, which saves the job, to the saved job, starting again
+// from the newly saved job if it was saved by someone else in the meantime.
+func modifyJob(runID string, f func(job *bench.Job) error) (bench.Job, error) {
+	for attempt := 1; ; attempt++ {
+		job, err := sm.GetJob(runID)
+		if err != nil {
+			return job, errors.Wrap(err, "error getting job")
+		}
+
+		err = f(&job)
+		if errors.Cause(err) == storage.ErrVersionConflict && attempt < modifyJobAttempts {
+			continue
+		}
+
+		return job, err
+	}
+}
+
+// stopContainers stops the containers of tasks in the background, since
+// stopping a container waits for it to exit.
+func stopContainers(tasks ...bench.Task) {
+	for _, task := range tasks {
+		if task.ContainerID == "" {
+			continue
+		}
+
+		go func(task bench.Task) {
+			err := cm.StopContainer(task.ContainerID)
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrapf(err, "error stopping task %s", task.ID)))
+			}
+		}(task)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// memStorage keeps jobs in memory, without checking versions. Only the
+// methods the watchdog and the task handlers use are implemented; the others
+// panic on the nil StorageManager.
+type memStorage struct {
+	StorageManager
+
+	mu   sync.Mutex
+	jobs map[string]bench.Job
+}
+
+func newMemStorage(jobs ...bench.Job) *memStorage {
+	s := &memStorage{jobs: map[string]bench.Job{}}
+
+	for _, job := range jobs {
+		s.jobs[job.RunID] = cloneJob(job)
+	}
+
+	return s
+}
+
+// cloneJob copies the tasks and histories of job, so saved jobs are not
+// changed through the jobs handed out.
+func cloneJob(job bench.Job) bench.Job {
+	job.History = append([]bench.Transition(nil), job.History...)
+
+	tasks := make([]bench.Task, len(job.Tasks))
+	for i, task := range job.Tasks {
+		tasks[i] = cloneTask(task)
+	}
+
+	job.Tasks = tasks
+
+	return job
+}
+
+func cloneTask(task bench.Task) bench.Task {
+	task.History = append([]bench.Transition(nil), task.History...)
+	return task
+}
+
+func (s *memStorage) GetJob(runID string) (bench.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[runID]
+	if !ok {
+		return job, errors.Errorf("no job %s", runID)
+	}
+
+	return cloneJob(job), nil
+}
+
+func (s *memStorage) UpdateJob(j *bench.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved, ok := s.jobs[j.RunID]
+	if !ok {
+		return errors.Errorf("no job %s", j.RunID)
+	}
+
+	j.Version++
+
+	job := cloneJob(*j)
+	job.Tasks = saved.Tasks
+
+	s.jobs[j.RunID] = job
+
+	return nil
+}
+
+func (s *memStorage) AddTask(runID string, t *bench.Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[runID]
+	if !ok {
+		return errors.Errorf("no job %s", runID)
+	}
+
+	t.Version++
+
+	job.Tasks = append(job.Tasks, cloneTask(*t))
+	s.jobs[runID] = job
+
+	return nil
+}
+
+func (s *memStorage) GetTask(runID, taskID string) (bench.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, task := range s.jobs[runID].Tasks {
+		if task.ID == taskID {
+			return cloneTask(task), nil
+		}
+	}
+
+	return bench.Task{}, errors.Errorf("no task %s", taskID)
+}
+
+func (s *memStorage) SaveTask(runID string, t *bench.Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, task := range s.jobs[runID].Tasks {
+		if task.ID == t.ID {
+			t.Version++
+			s.jobs[runID].Tasks[i] = cloneTask(*t)
+
+			return nil
+		}
+	}
+
+	return errors.Errorf("no task %s", t.ID)
+}
+
+func (s *memStorage) ModifyTask(runID, taskID string, f func(t *bench.Task) error) (bench.Task, error) {
+	t, err := s.GetTask(runID, taskID)
+	if err != nil {
+		return t, err
+	}
+
+	err = f(&t)
+	if err != nil {
+		return t, err
+	}
+
+	return t, s.SaveTask(runID, &t)
+}
+
+// fakeContainers counts the containers started, naming each after the task
+// it runs.
+type fakeContainers struct {
+	mu      sync.Mutex
+	started int
+}
+
+func (c *fakeContainers) StartContainer(env map[string]string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.started++
+
+	return "container-" + env["BENCH_RUNNER_ID"], nil
+}
+
+func (c *fakeContainers) StopContainer(id string) error {
+	return nil
+}
+
+func (c *fakeContainers) GetLogs(id string) (string, error) {
+	return "", nil
+}
+
+// containers is only set as cm once, since containers are stopped in the
+// background.
+var containers = &fakeContainers{}
+
+// setup stores jobs in memory for the handlers and the watchdog to use.
+func setup(jobs ...bench.Job) (*memStorage, *fakeContainers) {
+	readyTimeout = time.Minute
+	heartbeatTimeout = 30 * time.Second
+	resultGrace = time.Minute
+	startDelay = 0
+
+	if cm == nil {
+		cm = containers
+	}
+
+	containers.mu.Lock()
+	containers.started = 0
+	containers.mu.Unlock()
+
+	s := newMemStorage(jobs...)
+	sm = s
+
+	return s, containers
+}
+
+// newTask returns a task that reached state at, by way of the states before
+// it. Tasks that fail do so while provisioning.
+func newTask(id string, state bench.State, at time.Time) bench.Task {
+	path := []bench.State{bench.StatePending, bench.StateProvisioning, bench.StateReady, bench.StateRunning, bench.StateCompleted}
+	if state.Terminal() && state != bench.StateCompleted {
+		path = []bench.State{bench.StatePending, bench.StateProvisioning, state}
+	}
+
+	task := bench.Task{
+		ID:          id,
+		ContainerID: "container-" + id,
+		Env:         map[string]string{"BENCH_RUNNER_ID": id},
+	}
+
+	for _, s := range path {
+		err := task.Transition(s, at)
+		if err != nil {
+			panic(err)
+		}
+
+		if s == state {
+			break
+		}
+	}
+
+	return task
+}
+
+// newJob returns a job of tasks that reached state at, like newTask.
+func newJob(state bench.State, at time.Time, tasks ...bench.Task) bench.Job {
+	job := bench.Job{
+		RunID:       "run",
+		Duration:    time.Minute,
+		RequestTime: at,
+		Tasks:       tasks,
+	}
+
+	for _, s := range []bench.State{bench.StatePending, bench.StateProvisioning, bench.StateReady, bench.StateRunning} {
+		err := job.Transition(s, at)
+		if err != nil {
+			panic(err)
+		}
+
+		if s == state {
+			break
+		}
+	}
+
+	return job
+}
+
+func TestOverdue(t *testing.T) {
+	setup()
+
+	now := time.Now()
+
+	heard := func(task bench.Task, at time.Time) bench.Task {
+		task.Heartbeat = at
+		return task
+	}
+
+	tests := []struct {
+		name  string
+		job   bench.Job
+		task  bench.Task
+		state bench.State
+	}{
+		{
+			name: "pending",
+			job:  newJob(bench.StateProvisioning, now),
+			task: newTask("a", bench.StatePending, now.Add(-time.Second)),
+		},
+		{
+			name:  "not ready in time",
+			job:   newJob(bench.StateProvisioning, now),
+			task:  newTask("a", bench.StateProvisioning, now.Add(-2*time.Minute)),
+			state: bench.StateTimedOut,
+		},
+		{
+			name: "heard from",
+			job:  newJob(bench.StateRunning, now),
+			task: heard(newTask("a", bench.StateRunning, now.Add(-time.Minute)), now.Add(-time.Second)),
+		},
+		{
+			name:  "heartbeat overdue",
+			job:   newJob(bench.StateRunning, now),
+			task:  heard(newTask("a", bench.StateRunning, now.Add(-2*time.Minute)), now.Add(-time.Minute)),
+			state: bench.StateFailed,
+		},
+		{
+			name:  "never heard from",
+			job:   newJob(bench.StateProvisioning, now),
+			task:  newTask("a", bench.StateReady, now.Add(-time.Minute)),
+			state: bench.StateFailed,
+		},
+		{
+			name:  "no result",
+			job:   newJob(bench.StateRunning, now.Add(-3*time.Minute)),
+			task:  heard(newTask("a", bench.StateRunning, now.Add(-3*time.Minute)), now),
+			state: bench.StateTimedOut,
+		},
+	}
+
+	for _, tt := range tests {
+		state, reason := overdue(tt.job, tt.task, now)
+
+		if state != tt.state {
+			t.Errorf("%s: expected state %q, got %q (%s)", tt.name, tt.state, state, reason)
+		}
+
+		if (reason != "") != (state != "") {
+			t.Errorf("%s: expected a reason only when overdue, got %q", tt.name, reason)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	now := time.Now()
+	then := now.Add(-2 * time.Minute)
+
+	replaced := newTask("a", bench.StateTimedOut, then)
+	replaced.ReplacedBy = "c"
+
+	abort := func(job bench.Job) bench.Job {
+		job.FailurePolicy = bench.FailureAbort
+		return job
+	}
+
+	tests := []struct {
+		name  string
+		job   bench.Job
+		state bench.State
+		tasks []bench.State
+	}{
+		{
+			name:  "being launched",
+			job:   newJob(bench.StatePending, now, newTask("a", bench.StateReady, now)),
+			state: bench.StatePending,
+			tasks: []bench.State{bench.StateReady},
+		},
+		{
+			name:  "waiting for a task",
+			job:   newJob(bench.StateProvisioning, then, newTask("a", bench.StateReady, now), newTask("b", bench.StateProvisioning, now)),
+			state: bench.StateProvisioning,
+			tasks: []bench.State{bench.StateReady, bench.StateProvisioning},
+		},
+		{
+			name:  "every task ready",
+			job:   newJob(bench.StateProvisioning, then, newTask("a", bench.StateReady, now), newTask("b", bench.StateReady, now)),
+			state: bench.StateRunning,
+			tasks: []bench.State{bench.StateRunning, bench.StateRunning},
+		},
+		{
+			name:  "replaced task left out",
+			job:   abort(newJob(bench.StateProvisioning, then, replaced, newTask("b", bench.StateReady, now), newTask("c", bench.StateReady, now))),
+			state: bench.StateRunning,
+			tasks: []bench.State{bench.StateTimedOut, bench.StateRunning, bench.StateRunning},
+		},
+		{
+			name:  "task failed under continue",
+			job:   newJob(bench.StateRunning, then, newTask("a", bench.StateFailed, now), newTask("b", bench.StateRunning, then)),
+			state: bench.StateRunning,
+			tasks: []bench.State{bench.StateFailed, bench.StateRunning},
+		},
+		{
+			name:  "task failed under abort",
+			job:   abort(newJob(bench.StateRunning, then, newTask("a", bench.StateFailed, now), newTask("b", bench.StateRunning, then))),
+			state: bench.StateFailed,
+			tasks: []bench.State{bench.StateFailed, bench.StateCancelled},
+		},
+		{
+			name:  "task completed",
+			job:   newJob(bench.StateRunning, then, newTask("a", bench.StateCompleted, now), newTask("b", bench.StateRunning, then)),
+			state: bench.StateReporting,
+			tasks: []bench.State{bench.StateCompleted, bench.StateRunning},
+		},
+		{
+			name:  "every task ended",
+			job:   newJob(bench.StateRunning, then, newTask("a", bench.StateCompleted, now), newTask("b", bench.StateFailed, now)),
+			state: bench.StateCompleted,
+			tasks: []bench.State{bench.StateCompleted, bench.StateFailed},
+		},
+		{
+			name:  "every task failed",
+			job:   newJob(bench.StateRunning, then, newTask("a", bench.StateFailed, now), newTask("b", bench.StateTimedOut, now)),
+			state: bench.StateFailed,
+			tasks: []bench.State{bench.StateFailed, bench.StateTimedOut},
+		},
+	}
+
+	for _, tt := range tests {
+		setup(tt.job)
+
+		job := tt.job
+
+		err := settle(&job, now)
+		if err != nil {
+			t.Errorf("%s: %+v", tt.name, err)
+			continue
+		}
+
+		checkJob(t, tt.name, tt.state, tt.tasks)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	then := now.Add(-2 * time.Minute)
+
+	retry := func(retries int, job bench.Job) bench.Job {
+		job.Retries = retries
+		return job
+	}
+
+	attempt := func(n int, task bench.Task) bench.Task {
+		task.Attempt = n
+		return task
+	}
+
+	abort := func(job bench.Job) bench.Job {
+		job.FailurePolicy = bench.FailureAbort
+		return job
+	}
+
+	tests := []struct {
+		name     string
+		job      bench.Job
+		state    bench.State
+		tasks    []bench.State
+		replaced bool
+	}{
+		{
+			name:     "not ready in time",
+			job:      retry(1, newJob(bench.StateProvisioning, then, newTask("a", bench.StateProvisioning, then), newTask("b", bench.StateReady, now))),
+			state:    bench.StateProvisioning,
+			tasks:    []bench.State{bench.StateTimedOut, bench.StateReady, bench.StateProvisioning},
+			replaced: true,
+		},
+		{
+			name:     "heartbeat overdue",
+			job:      retry(1, newJob(bench.StateProvisioning, then, newTask("a", bench.StateReady, then), newTask("b", bench.StateReady, now))),
+			state:    bench.StateProvisioning,
+			tasks:    []bench.State{bench.StateFailed, bench.StateReady, bench.StateProvisioning},
+			replaced: true,
+		},
+		{
+			name:  "retries used up",
+			job:   retry(1, newJob(bench.StateProvisioning, then, attempt(1, newTask("a", bench.StateProvisioning, then)), newTask("b", bench.StateReady, now))),
+			state: bench.StateRunning,
+			tasks: []bench.State{bench.StateTimedOut, bench.StateRunning},
+		},
+		{
+			name:  "no retries under abort",
+			job:   abort(newJob(bench.StateProvisioning, then, newTask("a", bench.StateProvisioning, then), newTask("b", bench.StateReady, now))),
+			state: bench.StateFailed,
+			tasks: []bench.State{bench.StateTimedOut, bench.StateCancelled},
+		},
+		{
+			name:  "job already running",
+			job:   retry(1, newJob(bench.StateRunning, then, newTask("a", bench.StateRunning, then), newTask("b", bench.StateCompleted, now))),
+			state: bench.StateCompleted,
+			tasks: []bench.State{bench.StateFailed, bench.StateCompleted},
+		},
+	}
+
+	for _, tt := range tests {
+		s, c := setup(tt.job)
+
+		job := tt.job
+
+		err := reconcile(&job, now)
+		if err != nil {
+			t.Errorf("%s: %+v", tt.name, err)
+			continue
+		}
+
+		if !checkJob(t, tt.name, tt.state, tt.tasks) {
+			continue
+		}
+
+		saved := s.jobs["run"].Tasks
+		replacement := saved[len(saved)-1]
+
+		switch {
+		case !tt.replaced && c.started != 0:
+			t.Errorf("%s: expected no replacement, got %d", tt.name, c.started)
+		case !tt.replaced:
+		case c.started != 1:
+			t.Errorf("%s: expected one replacement, got %d", tt.name, c.started)
+		case saved[0].ReplacedBy != replacement.ID || replacement.Attempt != 1:
+			t.Errorf("%s: expected task %s to be replaced by attempt 1, got %+v", tt.name, saved[0].ID, replacement)
+		case replacement.ContainerID != "container-"+replacement.ID || replacement.TokenHash == "":
+			t.Errorf("%s: expected the replacement to be launched with a token, got %+v", tt.name, replacement)
+		}
+	}
+}
+
+// checkJob reports whether the saved job and its tasks are in the states
+// expected.
+func checkJob(t *testing.T, name string, state bench.State, tasks []bench.State) bool {
+	job, err := sm.GetJob("run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.State != state {
+		t.Errorf("%s: expected job %s, got %s", name, state, job.State)
+		return false
+	}
+
+	if len(job.Tasks) != len(tasks) {
+		t.Errorf("%s: expected %d tasks, got %d", name, len(tasks), len(job.Tasks))
+		return false
+	}
+
+	for i, task := range job.Tasks {
+		if task.State != tasks[i] {
+			t.Errorf("%s: expected task %s %s, got %s", name, task.ID, tasks[i], task.State)
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"math/big"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -23,19 +25,9 @@ var (
 	apiURL   string
 	runID    string
 	runnerID string
+	token    string
 )
 
-type randomIntReplacer struct {
-	max int
-	key string
-}
-
-func (r randomIntReplacer) Replace(s string) string {
-	val, _ := rand.Int(rand.Reader, big.NewInt(int64(r.max)))
-
-	return strings.Replace(s, r.key, strconv.FormatInt(val.Int64(), 10), 0)
-}
-
 func main() {
 	var err error
 	defer func() {
@@ -47,10 +39,18 @@ func main() {
 	viper.SetEnvPrefix("bench")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", `"`, ""))
+	viper.SetDefault("report-interval", 10*time.Second)
+	viper.SetDefault("heartbeat-interval", 5*time.Second)
+	viper.SetDefault("ready-retry-timeout", 2*time.Minute)
 
 	log.Println("starting")
 
 	for _, e := range os.Environ() {
+		// The token is a secret, and logs can be read through the API.
+		if strings.HasPrefix(e, "BENCH_TOKEN=") {
+			continue
+		}
+
 		log.Println(e)
 	}
 
@@ -60,36 +60,217 @@ func main() {
 
 	apiURL = viper.GetString("api-url")
 	runID = viper.GetString("run-id")
+	token = viper.GetString("token")
 
 	concurrency := viper.GetInt("concurrency")
+	rate := viper.GetFloat64("rate")
 	url := viper.GetString("url")
 	duration := viper.GetDuration("duration")
 	timeout := viper.GetDuration("timeout")
 
-	replacer := randomIntReplacer{
-		key: "{random}",
-		max: 5000000,
+	// {random} is kept for jobs written before generators were configurable.
+	generators := map[string]string{
+		"random": "randInt:0:4999999",
 	}
 
-	runner := bench.NewRunner(concurrency, duration, timeout, url, replacer)
+	if generatorsData := viper.GetString("generators"); generatorsData != "" {
+		err = json.Unmarshal([]byte(generatorsData), &generators)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding generators")))
+			return
+		}
+	}
 
-	log.Println("ready")
+	replacer, err := bench.NewTemplateReplacer(generators)
+	if err != nil {
+		log.Println(fmt.Sprintf("%+v", err))
+		return
+	}
+
+	var opts []bench.RunnerOption
+	if rate > 0 {
+		opts = append(opts, bench.WithRate(rate))
+	}
+
+	if requestData := viper.GetString("request"); requestData != "" {
+		var spec bench.RequestSpec
+
+		err = json.Unmarshal([]byte(requestData), &spec)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding request")))
+			return
+		}
+
+		opts = append(opts, bench.WithRequest(spec))
+	}
+
+	if scenarioData := viper.GetString("scenario"); scenarioData != "" {
+		var scenario bench.Scenario
+
+		err = json.Unmarshal([]byte(scenarioData), &scenario)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding scenario")))
+			return
+		}
+
+		opts = append(opts, bench.WithScenario(scenario))
+	}
+
+	if requestsData := viper.GetString("requests"); requestsData != "" {
+		var specs []bench.RequestSpec
+
+		err = json.Unmarshal([]byte(requestsData), &specs)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding requests")))
+			return
+		}
+
+		opts = append(opts, bench.WithMix(specs))
+	}
+
+	if feederData := viper.GetString("feeder"); feederData != "" {
+		var spec bench.FeederSpec
+
+		err = json.Unmarshal([]byte(feederData), &spec)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding feeder")))
+			return
+		}
+
+		var data []byte
+		data, err = getData("feeder")
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", err))
+			return
+		}
+
+		var feeder *bench.Feeder
+		feeder, err = bench.NewFeeder(spec, data, viper.GetInt("task-index"), viper.GetInt("task-count"))
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", err))
+			return
+		}
 
-	time.Sleep(10 * time.Second)
+		opts = append(opts, bench.WithFeeder(feeder))
+	}
 
-	err = sendReadyToStart()
+	if replayData := viper.GetString("replay"); replayData != "" {
+		var spec bench.ReplaySpec
+
+		err = json.Unmarshal([]byte(replayData), &spec)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding replay")))
+			return
+		}
+
+		var data []byte
+		data, err = getData("replay")
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", err))
+			return
+		}
+
+		var replay *bench.Replay
+		replay, err = bench.NewReplay(spec, data, viper.GetInt("task-index"), viper.GetInt("task-count"))
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", err))
+			return
+		}
+
+		opts = append(opts, bench.WithReplay(replay))
+	}
+
+	if histogramData := viper.GetString("histogram"); histogramData != "" {
+		var spec bench.HistogramSpec
+
+		err = json.Unmarshal([]byte(histogramData), &spec)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding histogram")))
+			return
+		}
+
+		opts = append(opts, bench.WithHistogram(spec))
+	}
+
+	if interval := viper.GetDuration("interval"); interval > 0 {
+		opts = append(opts, bench.WithInterval(interval))
+	}
+
+	if stagesData := viper.GetString("stages"); stagesData != "" {
+		var stages []bench.Stage
+
+		err = json.Unmarshal([]byte(stagesData), &stages)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error decoding stages")))
+			return
+		}
+
+		opts = append(opts, bench.WithStages(stages))
+	}
+
+	if viper.GetBool("cancel-in-flight") {
+		opts = append(opts, bench.WithCancelInFlight())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stopping a container, as ECS does when the task is stopped or the job
+	// cancelled, sends SIGTERM before killing it. The first signal stops the
+	// run so its partial result can still be reported; after that the
+	// default handling applies, so a second signal exits right away.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Println("stopping on", sig)
+			signal.Stop(sigs)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go sendHeartbeats(ctx, cancel)
+
+	log.Println("ready")
+
+	err = sendReadyToStart(ctx, viper.GetDuration("ready-retry-timeout"))
 	if err != nil {
 		log.Println(fmt.Sprintf("%+v", err))
 		return
 	}
 
-	err = waitForStart()
+	startAt, offset, err := waitForStart(ctx)
 	if err != nil {
 		log.Println(fmt.Sprintf("%+v", err))
 		return
 	}
 
-	result := runner.Run()
+	// startAt is on the API's clock.
+	localStart := startAt.Add(-offset)
+
+	log.Println("starting at", startAt, "clock offset", offset)
+
+	if wait := time.Until(localStart); wait < 0 {
+		log.Println("late for the start by", -wait)
+	}
+
+	select {
+	case <-time.After(time.Until(localStart)):
+	case <-ctx.Done():
+		log.Println("stopped before start")
+		return
+	}
+
+	runner := bench.NewRunner(concurrency, duration, timeout, url, replacer, append(opts, bench.WithClockOffset(offset))...)
+
+	done := make(chan struct{})
+	go reportProgress(runner, done, cancel)
+
+	result := runner.RunContext(ctx)
+	close(done)
 
 	err = sendResult(result)
 	if err != nil {
@@ -97,42 +278,218 @@ func main() {
 	}
 }
 
-func sendReadyToStart() error {
-	resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/readyToStart?runId=%s&runnerId=%s", apiURL, runID, runnerID))
+// callAPI sends a request to path on the API, authenticated with the token
+// issued to this runner.
+func callAPI(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", apiURL, path), body)
 	if err != nil {
-		return errors.Wrap(err, "error sending ready to start")
+		return nil, errors.Wrap(err, "error creating request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
+	return http.DefaultClient.Do(req)
+}
+
+func getData(name string) ([]byte, error) {
+	resp, err := callAPI("GET", fmt.Sprintf("data?runId=%s&runnerId=%s&name=%s", runID, runnerID, name), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data")
+	}
+
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("non-200 status code")
+		return nil, errors.New("non-200 status code")
 	}
 
-	return nil
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading data")
+	}
+
+	return data, nil
+}
+
+// sendReadyToStart tells the API this runner is ready. The API may not have
+// saved the task yet when the runner comes up quickly, or may be briefly
+// unavailable, so it tries again with backoff for up to timeout on network
+// errors, 401, 404 and 5xx responses.
+func sendReadyToStart(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 250 * time.Millisecond
+
+	for {
+		resp, err := callAPI("GET", fmt.Sprintf("readyToStart?runId=%s&runnerId=%s", runID, runnerID), nil)
+		if err != nil {
+			err = errors.Wrap(err, "error sending ready to start")
+		} else {
+			resp.Body.Close()
+
+			switch {
+			case resp.StatusCode == http.StatusOK:
+				return nil
+			case resp.StatusCode == http.StatusUnauthorized,
+				resp.StatusCode == http.StatusNotFound,
+				resp.StatusCode >= 500:
+				err = errors.Errorf("status code %d sending ready to start", resp.StatusCode)
+			default:
+				return errors.Errorf("status code %d sending ready to start", resp.StatusCode)
+			}
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		log.Println(err.Error(), "retrying in", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.New("stopped before start")
+		}
+
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
 }
 
-func waitForStart() error {
+// waitForStart polls the API until every runner is ready, and returns the
+// start time it schedules along with the offset of the API's clock from the
+// local one. The offset is estimated from the poll with the shortest round
+// trip, assuming the server time was read halfway through it.
+func waitForStart(ctx context.Context) (time.Time, time.Duration, error) {
+	var offset time.Duration
+	bestRTT := time.Duration(-1)
+
 	for {
-		resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/waitForStart?runId=%s", apiURL, runID))
+		sent := time.Now()
+
+		resp, err := callAPI("GET", fmt.Sprintf("waitForStart?runId=%s", runID), nil)
 		if err != nil {
-			return errors.Wrap(err, "error sending wait for start")
+			return time.Time{}, 0, errors.Wrap(err, "error sending wait for start")
+		}
+
+		received := time.Now()
+
+		var schedule struct {
+			StartAt    time.Time `json:"startAt"`
+			ServerTime time.Time `json:"serverTime"`
+		}
+
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+			err = json.NewDecoder(resp.Body).Decode(&schedule)
+		}
+
+		resp.Body.Close()
+
+		if err != nil {
+			return time.Time{}, 0, errors.Wrap(err, "error decoding start schedule")
+		}
+
+		if rtt := received.Sub(sent); bestRTT < 0 || rtt < bestRTT {
+			bestRTT = rtt
+			offset = schedule.ServerTime.Sub(sent.Add(rtt / 2))
 		}
 
 		if resp.StatusCode == http.StatusOK {
 			log.Println("ready to start")
-			return nil
+			return schedule.StartAt, offset, nil
 		}
 
 		if resp.StatusCode == http.StatusAccepted {
 			log.Println("still waiting for other runners to be ready")
-			time.Sleep(1 * time.Second)
+
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return time.Time{}, 0, errors.New("stopped before start")
+			}
+
+			continue
+		}
+
+		if resp.StatusCode == http.StatusGone {
+			return time.Time{}, 0, errors.New("job ended before it started")
+		}
+
+		return time.Time{}, 0, errors.New("unexpected status code")
+	}
+}
+
+// sendHeartbeats lets the API know the runner is alive until ctx is done. It
+// calls cancel if the API has given up on the task.
+func sendHeartbeats(ctx context.Context, cancel func()) {
+	ticker := time.NewTicker(viper.GetDuration("heartbeat-interval"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := callAPI("GET", fmt.Sprintf("heartbeat?runId=%s&runnerId=%s", runID, runnerID), nil)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error sending heartbeat")))
 			continue
 		}
 
-		return errors.New("unexpected status code")
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusGone {
+			log.Println("task ended by the api")
+			cancel()
+			return
+		}
+	}
+}
+
+// reportProgress sends the results collected so far every report interval
+// until done is closed, so a runner that dies mid-run does not lose all of
+// its results. It calls cancel if the job has been cancelled.
+func reportProgress(runner *bench.Runner, done <-chan struct{}, cancel func()) {
+	interval := viper.GetDuration("report-interval")
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := postResult("reportProgress", runner.Snapshot())
+			if errors.Cause(err) == errJobCancelled {
+				log.Println("job cancelled")
+				cancel()
+				return
+			}
+
+			if err != nil {
+				log.Println(fmt.Sprintf("%+v", errors.Wrap(err, "error sending progress")))
+			}
+		}
 	}
 }
 
+var errJobCancelled = errors.New("job cancelled")
+
 func sendResult(result bench.Result) error {
+	return postResult("reportResult", result)
+}
+
+func postResult(endpoint string, result bench.Result) error {
 	var b []byte
 	buf := bytes.NewBuffer(b)
 
@@ -141,11 +498,17 @@ func sendResult(result bench.Result) error {
 		return errors.Wrap(err, "error encoding result")
 	}
 
-	resp, err := http.DefaultClient.Post(fmt.Sprintf("%s/reportResult?runId=%s&runnerId=%s", apiURL, runID, runnerID), "application/json", buf)
+	resp, err := callAPI("POST", fmt.Sprintf("%s?runId=%s&runnerId=%s", endpoint, runID, runnerID), buf)
 	if err != nil {
 		return errors.Wrap(err, "error sending result")
 	}
 
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errJobCancelled
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return errors.New("non-200 status code")
 	}
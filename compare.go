@@ -0,0 +1,252 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// Percentiles are the latency percentiles compared between runs.
+var Percentiles = []float64{50, 75, 90, 95, 99, 99.9, 99.99, 100}
+
+// Thresholds are how much worse a candidate run may be than its baseline
+// before it counts as a regression.
+type Thresholds struct {
+	// Throughput is the largest drop in requests per second, as a fraction
+	// of the baseline.
+	Throughput float64 `json:"throughput"`
+	// ErrorRate is the largest rise in the fraction of requests that failed.
+	ErrorRate float64 `json:"errorRate"`
+	// Latency is the largest rise in any percentile, as a fraction of the
+	// baseline. A rise only counts if the latency distributions differ
+	// significantly.
+	Latency float64 `json:"latency"`
+	// Significance is the p-value below which the latency distributions are
+	// taken to differ.
+	Significance float64 `json:"significance"`
+}
+
+// DefaultThresholds allow a 5% drop in throughput, a rise of 1 point in the
+// error rate and a 10% rise in latency, tested at the 5% level.
+var DefaultThresholds = Thresholds{
+	Throughput:   0.05,
+	ErrorRate:    0.01,
+	Latency:      0.10,
+	Significance: 0.05,
+}
+
+// Delta is the change in a measure from the baseline to the candidate.
+// Relative is the change as a fraction of the baseline, or zero if the
+// baseline is zero.
+type Delta struct {
+	Name       string  `json:"name"`
+	Base       float64 `json:"base"`
+	Candidate  float64 `json:"candidate"`
+	Change     float64 `json:"change"`
+	Relative   float64 `json:"relative"`
+	Regression bool    `json:"regression"`
+}
+
+func newDelta(name string, base, candidate float64) Delta {
+	d := Delta{
+		Name:      name,
+		Base:      base,
+		Candidate: candidate,
+		Change:    candidate - base,
+	}
+
+	if base != 0 {
+		d.Relative = d.Change / base
+	}
+
+	return d
+}
+
+// KSTest is the two sample Kolmogorov-Smirnov test of whether two latency
+// distributions differ. Statistic is the largest distance between their
+// cumulative distributions.
+type KSTest struct {
+	Statistic   float64 `json:"statistic"`
+	PValue      float64 `json:"pValue"`
+	Significant bool    `json:"significant"`
+}
+
+// Comparison is how a candidate run did against its baseline. Throughput is in
+// requests per second, the error rate is a fraction of the requests and
+// latencies are in milliseconds. Pass is false if any measure regressed past
+// its threshold.
+type Comparison struct {
+	Thresholds  Thresholds `json:"thresholds"`
+	Throughput  Delta      `json:"throughput"`
+	ErrorRate   Delta      `json:"errorRate"`
+	Percentiles []Delta    `json:"percentiles"`
+	KS          KSTest     `json:"ks"`
+	Regressions []string   `json:"regressions"`
+	Pass        bool       `json:"pass"`
+}
+
+// Compare compares the merged results of two runs.
+func Compare(base, candidate Result, th Thresholds) Comparison {
+	c := Comparison{
+		Thresholds:  th,
+		Throughput:  newDelta("throughput", throughput(base), throughput(candidate)),
+		ErrorRate:   newDelta("errorRate", errorRate(base), errorRate(candidate)),
+		Regressions: []string{},
+	}
+
+	c.Throughput.Regression = c.Throughput.Base > 0 && -c.Throughput.Relative > th.Throughput
+	c.ErrorRate.Regression = c.ErrorRate.Change > th.ErrorRate
+
+	bh, ch := base.Hist(), candidate.Hist()
+
+	if bh != nil && ch != nil {
+		c.KS = ksTest(bh, base.resolution(), ch, candidate.resolution())
+		c.KS.Significant = c.KS.PValue < th.Significance
+
+		for _, p := range Percentiles {
+			d := newDelta(percentileName(p),
+				milliseconds(bh.ValueAtQuantile(p), base.resolution()),
+				milliseconds(ch.ValueAtQuantile(p), candidate.resolution()))
+
+			d.Regression = c.KS.Significant && d.Relative > th.Latency
+
+			c.Percentiles = append(c.Percentiles, d)
+		}
+	}
+
+	for _, d := range append([]Delta{c.Throughput, c.ErrorRate}, c.Percentiles...) {
+		if d.Regression {
+			c.Regressions = append(c.Regressions, d.Name)
+		}
+	}
+
+	c.Pass = len(c.Regressions) == 0
+
+	return c
+}
+
+func throughput(r Result) float64 {
+	if r.Time <= 0 {
+		return 0
+	}
+
+	return float64(r.Requests) / r.Time.Seconds()
+}
+
+// errorRate counts timeouts too, since they are also counted as errors.
+func errorRate(r Result) float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+func percentileName(p float64) string {
+	if p == 100 {
+		return "max"
+	}
+
+	return fmt.Sprintf("p%g", p)
+}
+
+func milliseconds(v int64, resolution time.Duration) float64 {
+	return float64(time.Duration(v)*resolution) / float64(time.Millisecond)
+}
+
+// step is where the cumulative distribution of a histogram rises, as the
+// share of its values that are at most at.
+type step struct {
+	at    time.Duration
+	share float64
+	base  bool
+}
+
+// ksTest compares the distributions of two histograms, which may have been
+// recorded at different resolutions. The p-value is the asymptotic one, which
+// is accurate for the sample sizes of a benchmark.
+func ksTest(a *hdrhistogram.Histogram, ares time.Duration, b *hdrhistogram.Histogram, bres time.Duration) KSTest {
+	n, m := a.TotalCount(), b.TotalCount()
+	if n == 0 || m == 0 {
+		return KSTest{PValue: 1}
+	}
+
+	var steps []step
+
+	add := func(h *hdrhistogram.Histogram, resolution time.Duration, total int64, base bool) {
+		var count int64
+
+		for _, bar := range h.Distribution() {
+			if bar.Count == 0 {
+				continue
+			}
+
+			count += bar.Count
+			steps = append(steps, step{
+				at:    time.Duration(bar.To) * resolution,
+				share: float64(count) / float64(total),
+				base:  base,
+			})
+		}
+	}
+
+	add(a, ares, n, true)
+	add(b, bres, m, false)
+
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].at < steps[j].at
+	})
+
+	var fa, fb, d float64
+
+	for i, s := range steps {
+		if s.base {
+			fa = s.share
+		} else {
+			fb = s.share
+		}
+
+		// Both distributions must have taken every step at a value before
+		// they are compared there.
+		if i+1 < len(steps) && steps[i+1].at == s.at {
+			continue
+		}
+
+		d = math.Max(d, math.Abs(fa-fb))
+	}
+
+	ne := float64(n) * float64(m) / float64(n+m)
+
+	return KSTest{
+		Statistic: d,
+		PValue:    kolmogorov((math.Sqrt(ne) + 0.12 + 0.11/math.Sqrt(ne)) * d),
+	}
+}
+
+// kolmogorov returns the probability of the Kolmogorov distribution exceeding
+// lambda.
+func kolmogorov(lambda float64) float64 {
+	if lambda < 0.2 {
+		return 1
+	}
+
+	var sum float64
+
+	for j := 1; j <= 100; j++ {
+		term := 2 * math.Exp(-2*float64(j*j)*lambda*lambda)
+		if j%2 == 0 {
+			term = -term
+		}
+
+		sum += term
+
+		if math.Abs(term) < 1e-12 {
+			break
+		}
+	}
+
+	return math.Min(math.Max(sum, 0), 1)
+}
@@ -0,0 +1,124 @@
+package bench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+// newCompareResult returns a result of requests taking the given latencies,
+// in units of resolution, over a second.
+func newCompareResult(resolution time.Duration, errors int, latencies ...int64) bench.Result {
+	r := bench.NewResult(bench.HistogramSpec{Resolution: resolution}.WithDefaults(time.Second))
+
+	for _, v := range latencies {
+		r.Hist().RecordValue(v)
+	}
+
+	r.Requests = len(latencies)
+	r.Errors = errors
+	r.Time = time.Second
+
+	return r
+}
+
+// spread returns n latencies evenly spread from min to max.
+func spread(n int, min, max int64) []int64 {
+	latencies := make([]int64, n)
+	for i := range latencies {
+		latencies[i] = min + (max-min)*int64(i)/int64(n-1)
+	}
+
+	return latencies
+}
+
+func TestCompare(t *testing.T) {
+	res := bench.DefaultResolution
+
+	tests := []struct {
+		name        string
+		base        bench.Result
+		candidate   bench.Result
+		regressions []string
+		significant bool
+	}{
+		{
+			name:      "same",
+			base:      newCompareResult(res, 10, spread(1000, 100, 500)...),
+			candidate: newCompareResult(res, 10, spread(1000, 100, 500)...),
+		},
+		{
+			name:        "slower",
+			base:        newCompareResult(res, 0, spread(1000, 100, 500)...),
+			candidate:   newCompareResult(res, 0, spread(1000, 150, 750)...),
+			regressions: []string{"p50", "p75", "p90", "p95", "p99", "p99.9", "p99.99", "max"},
+			significant: true,
+		},
+		{
+			name:        "faster",
+			base:        newCompareResult(res, 0, spread(1000, 150, 750)...),
+			candidate:   newCompareResult(res, 0, spread(1000, 100, 500)...),
+			significant: true,
+		},
+		{
+			name:        "lower throughput",
+			base:        newCompareResult(res, 0, spread(1000, 100, 500)...),
+			candidate:   newCompareResult(res, 0, spread(900, 100, 500)...),
+			regressions: []string{"throughput"},
+		},
+		{
+			name:        "more errors",
+			base:        newCompareResult(res, 10, spread(1000, 100, 500)...),
+			candidate:   newCompareResult(res, 30, spread(1000, 100, 500)...),
+			regressions: []string{"errorRate"},
+		},
+		{
+			// The slowest request is 20% slower, but five requests are
+			// too few to tell the distributions apart.
+			name:      "not significant",
+			base:      newCompareResult(res, 0, 10, 20, 30, 40, 50),
+			candidate: newCompareResult(res, 0, 12, 22, 33, 44, 60),
+		},
+		{
+			name:      "different resolutions",
+			base:      newCompareResult(100*time.Microsecond, 0, spread(1000, 100, 500)...),
+			candidate: newCompareResult(time.Millisecond, 0, spread(1000, 10, 50)...),
+		},
+	}
+
+	for _, tt := range tests {
+		c := bench.Compare(tt.base, tt.candidate, bench.DefaultThresholds)
+
+		if len(c.Regressions) != len(tt.regressions) {
+			t.Errorf("%s: expected regressions %v, got %v", tt.name, tt.regressions, c.Regressions)
+		} else {
+			for i := range tt.regressions {
+				if c.Regressions[i] != tt.regressions[i] {
+					t.Errorf("%s: expected regressions %v, got %v", tt.name, tt.regressions, c.Regressions)
+					break
+				}
+			}
+		}
+
+		if c.Pass != (len(tt.regressions) == 0) {
+			t.Errorf("%s: expected pass to be %t", tt.name, len(tt.regressions) == 0)
+		}
+
+		if c.KS.Significant != tt.significant {
+			t.Errorf("%s: expected significant to be %t, got D=%g p=%g", tt.name, tt.significant, c.KS.Statistic, c.KS.PValue)
+		}
+
+		if len(c.Percentiles) != len(bench.Percentiles) {
+			t.Errorf("%s: expected %d percentiles, got %d", tt.name, len(bench.Percentiles), len(c.Percentiles))
+		}
+	}
+}
+
+func TestCompareEmpty(t *testing.T) {
+	c := bench.Compare(bench.Result{}, bench.Result{}, bench.DefaultThresholds)
+
+	if !c.Pass || c.KS.Significant || len(c.Percentiles) != 0 {
+		t.Errorf("expected empty results to pass with nothing to compare, got %+v", c)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 type ECS interface {
 	RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error)
+	StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error)
 }
 
 type Logs interface {
@@ -84,6 +85,21 @@ func (c *AWS) StartContainer(env map[string]string) (string, error) {
 	return *output.Tasks[0].TaskArn, nil
 }
 
+// StopContainer stops the task. ECS sends SIGTERM and waits for the stop
+// timeout of the task definition before killing it.
+func (c *AWS) StopContainer(id string) error {
+	_, err := c.ecs.StopTask(&ecs.StopTaskInput{
+		Cluster: aws.String(c.cluster),
+		Task:    aws.String(id),
+		Reason:  aws.String("benchmark cancelled"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error stopping task")
+	}
+
+	return nil
+}
+
 func (c *AWS) GetLogs(id string) (string, error) {
 	var logs []string
 
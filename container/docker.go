@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -46,6 +47,23 @@ func (d *Docker) StartContainer(env map[string]string) (string, error) {
 	return output.ID, nil
 }
 
+// StopTimeout is how long a stopped container has to exit after SIGTERM before
+// it is killed, which gives a runner time to report its partial result.
+const StopTimeout = 30 * time.Second
+
+// StopContainer sends SIGTERM to the container, killing it if it is still
+// running after StopTimeout.
+func (d *Docker) StopContainer(id string) error {
+	timeout := StopTimeout
+
+	err := d.c.ContainerStop(context.Background(), id, &timeout)
+	if err != nil {
+		return errors.Wrap(err, "error stopping container")
+	}
+
+	return nil
+}
+
 func (d *Docker) GetLogs(id string) (string, error) {
 	rdr, err := d.c.ContainerLogs(context.Background(), id, types.ContainerLogsOptions{
 		ShowStdout: true,
@@ -0,0 +1,182 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Feeder formats.
+const (
+	FeederCSV   = "csv"
+	FeederJSONL = "jsonl"
+)
+
+// Feeder modes.
+const (
+	// FeederSequential hands out rows in order, wrapping around at the end.
+	FeederSequential = "sequential"
+	// FeederRandom hands out a random row every time.
+	FeederRandom = "random"
+	// FeederUnique gives every runner its own slice of the rows, so different
+	// runners never use the same row, and hands those out in order.
+	FeederUnique = "unique"
+)
+
+func (s FeederSpec) Validate() error {
+	switch s.Format {
+	case FeederCSV, FeederJSONL:
+	default:
+		return errors.Errorf("unknown feeder format %q", s.Format)
+	}
+
+	switch s.Mode {
+	case "", FeederSequential, FeederRandom, FeederUnique:
+	default:
+		return errors.Errorf("unknown feeder mode %q", s.Mode)
+	}
+
+	return nil
+}
+
+// ParseRows reads a CSV file with a header line, or a file with one JSON
+// object per line, into rows keyed by column.
+func ParseRows(format string, data []byte) ([]map[string]string, error) {
+	switch format {
+	case FeederCSV:
+		return parseCSV(data)
+	case FeederJSONL:
+		return parseJSONL(data)
+	}
+
+	return nil, errors.Errorf("unknown feeder format %q", format)
+}
+
+func parseCSV(data []byte) ([]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading csv")
+	}
+
+	if len(records) == 0 {
+		return nil, errors.New("csv must have a header line")
+	}
+
+	header := records[0]
+
+	var rows []map[string]string
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func parseJSONL(data []byte) ([]map[string]string, error) {
+	var rows []map[string]string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var obj map[string]interface{}
+
+		err := json.Unmarshal([]byte(text), &obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding line %d", line)
+		}
+
+		row := map[string]string{}
+		for k, v := range obj {
+			switch v := v.(type) {
+			case string:
+				row[k] = v
+			case float64:
+				row[k] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				row[k] = strconv.FormatBool(v)
+			case nil:
+				row[k] = ""
+			default:
+				encoded, _ := json.Marshal(v)
+				row[k] = string(encoded)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "error reading jsonl")
+	}
+
+	return rows, nil
+}
+
+// Feeder hands out rows of a dataset. The Runner binds one row to a virtual
+// user at the start of every iteration, so {column} placeholders in the URL,
+// headers and body of a request all come from the same row.
+type Feeder struct {
+	mode   string
+	rows   []map[string]string
+	cursor int64
+}
+
+// NewFeeder parses data according to spec. part and parts identify this
+// runner among all the runners of the job, and are only used by the unique
+// mode.
+func NewFeeder(spec FeederSpec, data []byte, part, parts int) (*Feeder, error) {
+	rows, err := ParseRows(spec.Format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Mode == FeederUnique && parts > 1 {
+		var own []map[string]string
+		for i := part; i < len(rows); i += parts {
+			own = append(own, rows[i])
+		}
+
+		rows = own
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("feeder has no rows")
+	}
+
+	return &Feeder{
+		mode: spec.Mode,
+		rows: rows,
+	}, nil
+}
+
+// Next returns the next row.
+func (f *Feeder) Next() map[string]string {
+	if f.mode == FeederRandom {
+		return f.rows[rand.Intn(len(f.rows))]
+	}
+
+	i := atomic.AddInt64(&f.cursor, 1) - 1
+
+	return f.rows[i%int64(len(f.rows))]
+}
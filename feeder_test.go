@@ -0,0 +1,96 @@
+package bench_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+const feederCSV = "id,term\n1,shoes\n2,hats\n3,socks\n4,belts\n"
+
+func TestFeederFormats(t *testing.T) {
+	rows, err := bench.ParseRows(bench.FeederCSV, []byte(feederCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 4 || rows[1]["term"] != "hats" {
+		t.Errorf("unexpected csv rows %v", rows)
+	}
+
+	rows, err = bench.ParseRows(bench.FeederJSONL, []byte("{\"id\":1,\"term\":\"shoes\"}\n\n{\"id\":2000000,\"term\":null}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0]["id"] != "1" || rows[1]["id"] != "2000000" || rows[1]["term"] != "" {
+		t.Errorf("unexpected jsonl rows %v", rows)
+	}
+}
+
+func TestFeederUnique(t *testing.T) {
+	spec := bench.FeederSpec{Format: bench.FeederCSV, Mode: bench.FeederUnique}
+
+	seen := map[string]int{}
+
+	for part := 0; part < 2; part++ {
+		f, err := bench.NewFeeder(spec, []byte(feederCSV), part, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			seen[f.Next()["id"]]++
+		}
+	}
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if seen[id] != 1 {
+			t.Errorf("expected row %s to be used by exactly one runner, got %d", id, seen[id])
+		}
+	}
+}
+
+func TestRunnerFeeder(t *testing.T) {
+	var mu sync.Mutex
+	mismatched := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/items/"+r.Header.Get("X-Id") {
+			mismatched++
+		}
+	}))
+	defer srv.Close()
+
+	f, err := bench.NewFeeder(bench.FeederSpec{Format: bench.FeederCSV}, []byte(feederCSV), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := bench.RequestSpec{
+		URL:     srv.URL + "/items/{id}",
+		Headers: map[string]string{"X-Id": "{id}"},
+	}
+
+	r := bench.NewRunner(2, 100*time.Millisecond, 100*time.Millisecond, "", nil, bench.WithRequest(spec), bench.WithFeeder(f))
+
+	result := r.Run()
+
+	if result.StatusCodes[200] == 0 {
+		t.Fatalf("expected requests, got %v", result.StatusCodes)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if mismatched > 0 {
+		t.Errorf("expected url and header to use the same row, %d requests did not", mismatched)
+	}
+}
@@ -0,0 +1,118 @@
+package bench
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/pkg/errors"
+)
+
+// Histogram defaults, matching the histograms recorded before they were
+// configurable.
+const (
+	DefaultResolution = 100 * time.Microsecond
+	DefaultSigFigs    = 2
+)
+
+// UnmarshalJSON accepts the resolution and max either as nanoseconds or as
+// duration strings such as "1ms".
+func (s *HistogramSpec) UnmarshalJSON(data []byte) error {
+	type histogramSpec HistogramSpec
+
+	aux := struct {
+		*histogramSpec
+		Resolution interface{} `json:"resolution"`
+		Max        interface{} `json:"max"`
+	}{
+		histogramSpec: (*histogramSpec)(s),
+	}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	s.Resolution, err = jsonDuration(aux.Resolution)
+	if err != nil {
+		return errors.Wrap(err, "error parsing histogram resolution")
+	}
+
+	s.Max, err = jsonDuration(aux.Max)
+	if err != nil {
+		return errors.Wrap(err, "error parsing histogram max")
+	}
+
+	return nil
+}
+
+func (s HistogramSpec) Validate() error {
+	if s.Resolution < 0 || s.Max < 0 {
+		return errors.New("histogram resolution and max must be >= 0")
+	}
+
+	if s.SigFigs < 0 || s.SigFigs > 5 {
+		return errors.New("histogram sigFigs must be between 1 and 5, or 0 for the default")
+	}
+
+	if s.Resolution > 0 && s.Max > 0 && s.Max < 2*s.Resolution {
+		return errors.New("histogram max must be at least twice the resolution")
+	}
+
+	return nil
+}
+
+// DefaultMax returns the default range of the histograms of a run. A request
+// cannot take longer than timeout in a closed model, but a rate driven run
+// measures latency from when each request was due, so a request queued behind
+// slow ones may take up to the whole duration longer.
+func DefaultMax(timeout, duration time.Duration, rateDriven bool) time.Duration {
+	if rateDriven {
+		return timeout + duration
+	}
+
+	return timeout
+}
+
+// WithDefaults fills in the unset fields, with max as the range. See
+// DefaultMax.
+func (s HistogramSpec) WithDefaults(max time.Duration) HistogramSpec {
+	if s.Resolution == 0 {
+		s.Resolution = DefaultResolution
+	}
+
+	if s.Max == 0 {
+		s.Max = max
+	}
+
+	if s.Max < 2*s.Resolution {
+		s.Max = 2 * s.Resolution
+	}
+
+	if s.SigFigs == 0 {
+		s.SigFigs = DefaultSigFigs
+	}
+
+	return s
+}
+
+func (s HistogramSpec) new() *hdrhistogram.Histogram {
+	return hdrhistogram.New(0, int64(s.Max/s.Resolution), s.SigFigs)
+}
+
+// record adds d to h in units of resolution. Values outside the range of the
+// histogram are recorded as its lowest or highest trackable value, so the
+// histogram still counts every request. In rate mode, latency is measured from
+// the intended send time, so it may exceed a range that was set explicitly.
+func record(h *hdrhistogram.Histogram, resolution, d time.Duration) {
+	v := int64(d / resolution)
+	if max := h.HighestTrackableValue(); v > max {
+		v = max
+	}
+
+	if min := h.LowestTrackableValue(); v < min {
+		v = min
+	}
+
+	h.RecordValue(v)
+}
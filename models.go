@@ -1,6 +1,7 @@
 package bench
 
 import (
+	"regexp"
 	"time"
 
 	"github.com/codahale/hdrhistogram"
@@ -13,33 +14,210 @@ type Task struct {
 	Result      *Result `json:"result"`
 	Logs        string  `json:"logs"`
 	Concurrency int     `json:"concurrency"`
+	Rate        float64 `json:"rate,omitempty"`
+	Stages      []Stage `json:"stages,omitempty"`
+
+	State   State        `json:"state"`
+	History []Transition `json:"history,omitempty"`
+	Error   string       `json:"error,omitempty"`
+
+	// TokenHash is the SHA-256 of the secret the runner authenticates with.
+	// Only the hash is kept, so the task can be shown safely.
+	TokenHash string `json:"tokenHash,omitempty"`
+
+	// Heartbeat is the last time the runner was heard from.
+	Heartbeat time.Time `json:"heartbeat,omitempty"`
+
+	// Env is the environment the container was started with, kept so a
+	// replacement can be launched. Attempt counts the launches before this
+	// one, and ReplacedBy is the ID of the task that replaced this one.
+	Env        map[string]string `json:"env,omitempty"`
+	Attempt    int               `json:"attempt,omitempty"`
+	ReplacedBy string            `json:"replacedBy,omitempty"`
+
+	// Progress is the latest interim result reported while the task is
+	// running. It is cumulative, so it is replaced rather than merged.
+	Progress     *Result   `json:"progress,omitempty"`
+	ProgressTime time.Time `json:"progressTime,omitempty"`
+
+	// Version is bumped every time the task is saved. A task is only saved
+	// if the saved one is still at the version it was read at.
+	Version int64 `json:"version"`
 }
 
 type Job struct {
 	RunID       string        `json:"runId"`
 	Concurrency int           `json:"concurrency"`
+	Rate        float64       `json:"rate,omitempty"`
 	Duration    time.Duration `json:"duration"`
 	Timeout     time.Duration `json:"timeout"`
 	URL         string        `json:"url"`
+	Stages      []Stage       `json:"stages,omitempty"`
+	Request     *RequestSpec  `json:"request,omitempty"`
+	Scenario    *Scenario     `json:"scenario,omitempty"`
+	Requests    []RequestSpec `json:"requests,omitempty"`
+
+	// Generators names generator expressions for the TemplateReplacer, such
+	// as "id": "randInt:1:5000000" for an {id} placeholder.
+	Generators map[string]string `json:"generators,omitempty"`
+	Feeder     *FeederSpec       `json:"feeder,omitempty"`
+	Replay     *ReplaySpec       `json:"replay,omitempty"`
+
+	Histogram HistogramSpec `json:"histogram"`
+	Interval  time.Duration `json:"interval,omitempty"`
+
+	// CancelInFlight cancels the requests still in flight when a runner
+	// stops instead of waiting for them.
+	CancelInFlight bool `json:"cancelInFlight,omitempty"`
 
 	MetaData map[string]string `json:"meta"`
 
+	State   State        `json:"state"`
+	History []Transition `json:"history,omitempty"`
+
+	// Version is bumped every time the job is saved, like Task.Version.
+	Version int64 `json:"version"`
+
+	// FailurePolicy is FailureContinue or FailureAbort. Retries is how many
+	// times a task that fails before the job starts is replaced.
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+	Retries       int    `json:"retries,omitempty"`
+
 	RequestTime time.Time `json:"requestTime"`
-	StartTime   time.Time `json:"startTime"`
-	EndTime     time.Time `json:"endTime"`
+	// StartTime is when every runner starts, scheduled shortly after all of
+	// them are ready so they all have time to hear of it.
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
 
 	Tasks []Task `json:"tasks"`
 }
 
+// Stage is one step of a load profile. A stage targets either a concurrency
+// or a rate; a ramp stage moves linearly from the previous stage's target to
+// its own over its duration, while any other stage jumps straight to it.
+type Stage struct {
+	Name        string        `json:"name,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Concurrency int           `json:"concurrency,omitempty"`
+	Rate        float64       `json:"rate,omitempty"`
+	Ramp        bool          `json:"ramp,omitempty"`
+}
+
+// RequestSpec describes the HTTP request a Runner sends. The Replacer is
+// applied to the URL, query values, header values and body of every request.
+type RequestSpec struct {
+	Name    string            `json:"name,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	// Weight is the relative share of iterations that pick this request when
+	// it is part of a weighted mix.
+	Weight int `json:"weight,omitempty"`
+
+	Extract    []Extraction `json:"extract,omitempty"`
+	Assertions []Assertion  `json:"assert,omitempty"`
+}
+
+// Assertion checks the correctness of a response. Type is one of "status",
+// "bodyContains", "bodyRegex", "jsonPath", "maxBodySize" or "header", and
+// decides which of the other fields are used. Failures are counted per Name,
+// which defaults to a description of the assertion.
+type Assertion struct {
+	re *regexp.Regexp
+
+	Name  string `json:"name,omitempty"`
+	Type  string `json:"type"`
+	Min   int    `json:"min,omitempty"`
+	Max   int    `json:"max,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// Scenario is an ordered list of requests that each virtual user runs in turn
+// on every iteration.
+type Scenario struct {
+	Name  string        `json:"name,omitempty"`
+	Steps []RequestSpec `json:"steps"`
+}
+
+// Extraction stores a value from a response in a per virtual user variable,
+// which later requests reference as {name}. Source is one of "json" (a dotted
+// path such as "data.items[0].id"), "regex" (the first group, or the whole
+// match) or "header".
+type Extraction struct {
+	re *regexp.Regexp
+
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Expression string `json:"expression"`
+}
+
+// FeederSpec describes the dataset uploaded with a job. Format is "csv" or
+// "jsonl" and Mode is "sequential" (the default), "random" or "unique".
+type FeederSpec struct {
+	Format string `json:"format"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// ReplaySpec describes an access log uploaded with a job. Format is
+// "combined" or "jsonl", and the logged paths are sent to BaseURL. A Speed of
+// 1 replays the log once at its recorded timing and 2 replays it twice as
+// fast; 0 loops over it as fast as the concurrency allows.
+type ReplaySpec struct {
+	Format  string  `json:"format"`
+	BaseURL string  `json:"baseUrl"`
+	Speed   float64 `json:"speed,omitempty"`
+}
+
+// HistogramSpec sets the range and precision of latency histograms. Latencies
+// are recorded in units of Resolution, up to Max, with SigFigs significant
+// figures. Fields left at zero take their defaults. Results can only be merged
+// when they use the same settings.
+type HistogramSpec struct {
+	Resolution time.Duration `json:"resolution,omitempty"`
+	Max        time.Duration `json:"max,omitempty"`
+	SigFigs    int           `json:"sigFigs,omitempty"`
+}
+
 type Result struct {
-	h *hdrhistogram.Histogram
+	h      *hdrhistogram.Histogram
+	phases map[string]*hdrhistogram.Histogram
 
+	Name        string                 `json:"name,omitempty"`
 	Requests    int                    `json:"requests"`
 	Errors      int                    `json:"errors"`
 	Timeouts    int                    `json:"timeouts"`
+	Dropped     int                    `json:"dropped"`
+	Late        int                    `json:"late"`
 	StatusCodes map[int]int            `json:"statusCodes"`
 	Time        time.Duration          `json:"time"`
 	Histogram   *hdrhistogram.Snapshot `json:"histogram"`
+	Resolution  time.Duration          `json:"resolution,omitempty"`
 	StartTime   time.Time              `json:"startTime"`
 	EndTime     time.Time              `json:"endTime"`
+	Stages      []Result               `json:"stages,omitempty"`
+	Endpoints   map[string]*Result     `json:"endpoints,omitempty"`
+
+	// Intervals breaks the run down into fixed, wall clock aligned buckets,
+	// sorted by start time.
+	Intervals []Result `json:"intervals,omitempty"`
+
+	ExtractionErrors int `json:"extractionErrors,omitempty"`
+
+	// Cancelled counts requests that were in flight when the run stopped and
+	// were cancelled rather than waited for. They are not counted in
+	// Requests.
+	Cancelled int `json:"cancelled,omitempty"`
+
+	// AssertionFailures counts responses that failed at least one assertion,
+	// and Assertions counts the failures of each assertion by name.
+	AssertionFailures int            `json:"assertionFailures,omitempty"`
+	Assertions        map[string]int `json:"assertions,omitempty"`
+
+	// Phases holds a histogram per request phase (see Phases). Only the top
+	// level result of a run records them.
+	Phases map[string]*hdrhistogram.Snapshot `json:"phases,omitempty"`
 }
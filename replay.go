@@ -0,0 +1,202 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Access log formats.
+const (
+	// ReplayCombined is the nginx/Apache combined log format.
+	ReplayCombined = "combined"
+	// ReplayJSONL is one JSON object per line with time, method, path and
+	// headers fields.
+	ReplayJSONL = "jsonl"
+)
+
+func (s ReplaySpec) Validate() error {
+	switch s.Format {
+	case ReplayCombined, ReplayJSONL:
+	default:
+		return errors.Errorf("unknown replay format %q", s.Format)
+	}
+
+	u, err := url.Parse(s.BaseURL)
+	if err != nil || !u.IsAbs() {
+		return errors.New("replay baseUrl must be a valid absolute url")
+	}
+
+	if s.Speed < 0 {
+		return errors.New("replay speed must be >= 0")
+	}
+
+	return nil
+}
+
+// LogEntry is one request read from an access log.
+type LogEntry struct {
+	Time    time.Time         `json:"time"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+var combinedLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" \S+ \S+(?: "([^"]*)" "([^"]*)")?`)
+
+const combinedTime = "02/Jan/2006:15:04:05 -0700"
+
+// ParseAccessLog reads the requests out of an access log. Lines that cannot be
+// parsed are skipped.
+func ParseAccessLog(format string, data []byte) ([]LogEntry, error) {
+	var entries []LogEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var e LogEntry
+		var ok bool
+
+		switch format {
+		case ReplayCombined:
+			e, ok = parseCombined(line)
+		case ReplayJSONL:
+			ok = json.Unmarshal([]byte(line), &e) == nil && e.Path != ""
+		default:
+			return nil, errors.Errorf("unknown replay format %q", format)
+		}
+
+		if !ok {
+			continue
+		}
+
+		if e.Method == "" {
+			e.Method = "GET"
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading access log")
+	}
+
+	return entries, nil
+}
+
+func parseCombined(line string) (LogEntry, bool) {
+	m := combinedLine.FindStringSubmatch(line)
+	if m == nil {
+		return LogEntry{}, false
+	}
+
+	t, err := time.Parse(combinedTime, m[1])
+	if err != nil {
+		return LogEntry{}, false
+	}
+
+	e := LogEntry{
+		Time:    t,
+		Method:  m[2],
+		Path:    m[3],
+		Headers: map[string]string{},
+	}
+
+	if m[4] != "" && m[4] != "-" {
+		e.Headers["Referer"] = m[4]
+	}
+
+	if m[5] != "" && m[5] != "-" {
+		e.Headers["User-Agent"] = m[5]
+	}
+
+	return e, true
+}
+
+// Replay hands out the requests of an access log in order.
+type Replay struct {
+	speed float64
+	// start is the time of the first entry of the whole log, which every
+	// part of it is timed from.
+	start   time.Time
+	entries []LogEntry
+	specs   []RequestSpec
+	cursor  int64
+}
+
+// NewReplay parses the access log and keeps every parts'th entry starting at
+// part, so the runners of a job share the log between them while keeping its
+// timing.
+func NewReplay(spec ReplaySpec, data []byte, part, parts int) (*Replay, error) {
+	entries, err := ParseAccessLog(spec.Format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var start time.Time
+	if len(entries) > 0 {
+		start = entries[0].Time
+	}
+
+	if parts > 1 {
+		var own []LogEntry
+		for i := part; i < len(entries); i += parts {
+			own = append(own, entries[i])
+		}
+
+		entries = own
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("access log has no requests")
+	}
+
+	base := strings.TrimSuffix(spec.BaseURL, "/")
+
+	specs := make([]RequestSpec, len(entries))
+	for i, e := range entries {
+		specs[i] = RequestSpec{
+			Method:  e.Method,
+			URL:     base + e.Path,
+			Headers: e.Headers,
+		}
+	}
+
+	return &Replay{
+		speed:   spec.Speed,
+		start:   start,
+		entries: entries,
+		specs:   specs,
+	}, nil
+}
+
+// timed reports whether the log is replayed at its recorded timing, scaled
+// by the speed, rather than as fast as the workers allow.
+func (rp *Replay) timed() bool {
+	return rp.speed > 0
+}
+
+// next returns the next request, wrapping around at the end of the log.
+func (rp *Replay) next() RequestSpec {
+	i := atomic.AddInt64(&rp.cursor, 1) - 1
+
+	return rp.specs[i%int64(len(rp.specs))]
+}
+
+// offset is when entry i should be sent, relative to the start of the run.
+func (rp *Replay) offset(i int) time.Duration {
+	return time.Duration(float64(rp.entries[i].Time.Sub(rp.start)) / rp.speed)
+}
@@ -0,0 +1,121 @@
+package bench_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+const combinedLog = `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /items/1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"
+this line is not a request
+127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "POST /cart HTTP/1.1" 201 12 "-" "curl/7.0"
+127.0.0.1 - - [10/Oct/2000:13:55:37 -0700] "GET /search?q=hats HTTP/1.1" 200 512
+`
+
+func TestParseAccessLog(t *testing.T) {
+	entries, err := bench.ParseAccessLog(bench.ReplayCombined, []byte(combinedLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	if entries[0].Method != "GET" || entries[0].Path != "/items/1" || entries[0].Headers["User-Agent"] != "Mozilla/4.08" {
+		t.Errorf("unexpected first entry %+v", entries[0])
+	}
+
+	if entries[1].Method != "POST" || entries[1].Headers["Referer"] != "" {
+		t.Errorf("unexpected second entry %+v", entries[1])
+	}
+
+	if entries[2].Time.Sub(entries[0].Time) != time.Second {
+		t.Errorf("expected entries a second apart, got %s", entries[2].Time.Sub(entries[0].Time))
+	}
+}
+
+func TestRunnerReplayTimed(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	rp, err := bench.NewReplay(bench.ReplaySpec{Format: bench.ReplayCombined, BaseURL: srv.URL, Speed: 4}, []byte(combinedLog), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bench.NewRunner(2, 2*time.Second, 100*time.Millisecond, "", nil, bench.WithReplay(rp))
+
+	result := r.Run()
+
+	if result.Requests != 3 {
+		t.Errorf("expected the log to be replayed once, got %d requests", result.Requests)
+	}
+
+	// The log spans a second, so at 4x it should take about 250ms.
+	if result.Time > time.Second {
+		t.Errorf("expected the replay to end with the log, took %s", result.Time)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := map[string]bool{"GET /items/1": true, "POST /cart": true, "GET /search?q=hats": true}
+	for _, p := range paths {
+		if !want[p] {
+			t.Errorf("unexpected request %s", p)
+		}
+	}
+}
+
+func TestRunnerReplayTimedPart(t *testing.T) {
+	log := `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /a HTTP/1.1" 200 1
+127.0.0.1 - - [10/Oct/2000:13:55:37 -0700] "GET /b HTTP/1.1" 200 1
+127.0.0.1 - - [10/Oct/2000:13:55:38 -0700] "GET /c HTTP/1.1" 200 1
+`
+
+	var mu sync.Mutex
+	var sent time.Time
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = time.Now()
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	// The second part only has /b, a second into the log.
+	rp, err := bench.NewReplay(bench.ReplaySpec{Format: bench.ReplayCombined, BaseURL: srv.URL, Speed: 2}, []byte(log), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bench.NewRunner(1, 2*time.Second, 100*time.Millisecond, "", nil, bench.WithReplay(rp))
+
+	start := time.Now()
+
+	result := r.Run()
+
+	if result.Requests != 1 {
+		t.Fatalf("expected 1 request, got %d", result.Requests)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// At 2x, /b is due half a second into the run.
+	if d := sent.Sub(start); d < 400*time.Millisecond {
+		t.Errorf("expected the part to keep its place in the log, sent after %s", d)
+	}
+}
@@ -0,0 +1,162 @@
+package bench
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NewRequest builds an http.Request from the spec, applying replacer to the
+// URL, query values, header values and body.
+func (s RequestSpec) NewRequest(replacer Replacer) (*http.Request, error) {
+	method := s.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	u, err := url.Parse(replacer.Replace(s.URL))
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing url")
+	}
+
+	if len(s.Query) > 0 {
+		q := u.Query()
+		for k, v := range s.Query {
+			q.Set(k, replacer.Replace(v))
+		}
+
+		u.RawQuery = q.Encode()
+	}
+
+	var body io.Reader
+	if s.Body != "" {
+		body = strings.NewReader(replacer.Replace(s.Body))
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating request")
+	}
+
+	for k, v := range s.Headers {
+		v = replacer.Replace(v)
+
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
+
+// Validate checks the parts of the spec that do not depend on the Replacer.
+func (s RequestSpec) Validate() error {
+	if s.Method != "" && strings.IndexFunc(s.Method, func(r rune) bool {
+		return r < 'A' || r > 'Z'
+	}) >= 0 {
+		return errors.New("method must be an upper case HTTP method")
+	}
+
+	u, err := url.Parse(s.URL)
+	if err != nil || !u.IsAbs() {
+		return errors.New("url must be a valid absolute url")
+	}
+
+	for i, a := range s.Assertions {
+		err = a.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "assertion %d", i)
+		}
+	}
+
+	return nil
+}
+
+// compile prepares the spec's extractions and assertions for use by a Runner.
+func (s RequestSpec) compile() RequestSpec {
+	extract := make([]Extraction, len(s.Extract))
+
+	for i, e := range s.Extract {
+		if e.Source == ExtractRegex {
+			e.re, _ = regexp.Compile(e.Expression)
+		}
+
+		extract[i] = e
+	}
+
+	s.Extract = extract
+
+	assertions := make([]Assertion, len(s.Assertions))
+
+	for i, a := range s.Assertions {
+		if a.Name == "" {
+			a.Name = a.defaultName()
+		}
+
+		if a.Type == AssertBodyRegex {
+			a.re, _ = regexp.Compile(a.Value)
+		}
+
+		assertions[i] = a
+	}
+
+	s.Assertions = assertions
+
+	return s
+}
+
+// needsBody reports whether the response body has to be kept to handle the
+// extractions and assertions of the spec.
+func (s RequestSpec) needsBody() bool {
+	if len(s.Extract) > 0 {
+		return true
+	}
+
+	for _, a := range s.Assertions {
+		if a.needsBody() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateMix checks a weighted request mix. Every request needs a unique
+// name, since results are broken down by it, and a positive weight.
+func ValidateMix(specs []RequestSpec) error {
+	if len(specs) == 0 {
+		return errors.New("mix must have at least one request")
+	}
+
+	names := map[string]bool{}
+
+	for i, spec := range specs {
+		if spec.Name == "" {
+			return errors.Errorf("request %d: name must not be empty", i)
+		}
+
+		if names[spec.Name] {
+			return errors.Errorf("request %d: duplicate name %q", i, spec.Name)
+		}
+
+		names[spec.Name] = true
+
+		if spec.Weight <= 0 {
+			return errors.Errorf("request %s: weight must be > 0", spec.Name)
+		}
+
+		err := spec.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "request %s", spec.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package bench
+
+import (
+	"sort"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/pkg/errors"
+)
+
+// DefaultInterval is the default length of the buckets of Result.Intervals.
+const DefaultInterval = time.Second
+
+// ErrHistogramMismatch is returned when merging results whose histograms were
+// recorded with different settings.
+var ErrHistogramMismatch = errors.New("histogram settings do not match")
+
+// NewResult returns an empty Result with a histogram as described by spec,
+// which must have its defaults filled in.
+func NewResult(spec HistogramSpec) Result {
+	return Result{
+		StatusCodes: map[int]int{},
+		Resolution:  spec.Resolution,
+		h:           spec.new(),
+	}
+}
+
+func (r *Result) Hist() *hdrhistogram.Histogram {
+	if r.h != nil {
+		return r.h
+	}
+
+	if r.Histogram != nil {
+		r.h = hdrhistogram.Import(r.Histogram)
+		return r.h
+	}
+
+	return nil
+}
+
+// resolution is the unit of the histogram. Results reported before it was
+// configurable leave it unset.
+func (r *Result) resolution() time.Duration {
+	if r.Resolution == 0 {
+		return DefaultResolution
+	}
+
+	return r.Resolution
+}
+
+// Merge adds the counts and latencies of o to r. Stage breakdowns are matched
+// by index and endpoint breakdowns by name. It returns ErrHistogramMismatch,
+// leaving r unchanged, if the histograms were recorded with different
+// settings.
+func (r *Result) Merge(o Result) error {
+	err := r.checkMergeable(o)
+	if err != nil {
+		return err
+	}
+
+	r.merge(o)
+
+	return nil
+}
+
+func (r *Result) checkMergeable(o Result) error {
+	if h, oh := r.Hist(), o.Hist(); h != nil && oh != nil {
+		if r.resolution() != o.resolution() ||
+			h.LowestTrackableValue() != oh.LowestTrackableValue() ||
+			h.HighestTrackableValue() != oh.HighestTrackableValue() ||
+			h.SignificantFigures() != oh.SignificantFigures() {
+			return ErrHistogramMismatch
+		}
+	}
+
+	for phase := range o.Phases {
+		if h, oh := r.PhaseHist(phase), o.PhaseHist(phase); h != nil && oh != nil {
+			if h.HighestTrackableValue() != oh.HighestTrackableValue() || h.SignificantFigures() != oh.SignificantFigures() {
+				return ErrHistogramMismatch
+			}
+		}
+	}
+
+	for i, s := range o.Stages {
+		if i < len(r.Stages) {
+			err := r.Stages[i].checkMergeable(s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, e := range o.Endpoints {
+		if r.Endpoints[name] != nil {
+			err := r.Endpoints[name].checkMergeable(*e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, oi := range o.Intervals {
+		for i := range r.Intervals {
+			if r.Intervals[i].StartTime.Equal(oi.StartTime) {
+				err := r.Intervals[i].checkMergeable(oi)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Result) merge(o Result) {
+	r.Requests += o.Requests
+	r.Errors += o.Errors
+	r.Timeouts += o.Timeouts
+	r.Dropped += o.Dropped
+	r.Cancelled += o.Cancelled
+	r.Late += o.Late
+	r.ExtractionErrors += o.ExtractionErrors
+	r.AssertionFailures += o.AssertionFailures
+
+	for k, v := range o.Assertions {
+		if r.Assertions == nil {
+			r.Assertions = map[string]int{}
+		}
+
+		r.Assertions[k] += v
+	}
+
+	if r.StatusCodes == nil {
+		r.StatusCodes = map[int]int{}
+	}
+
+	for k, v := range o.StatusCodes {
+		r.StatusCodes[k] += v
+	}
+
+	if oh := o.Hist(); oh != nil {
+		h := r.Hist()
+		if h == nil {
+			h = hdrhistogram.New(oh.LowestTrackableValue(), oh.HighestTrackableValue(), int(oh.SignificantFigures()))
+			r.h = h
+			r.Resolution = o.Resolution
+		}
+
+		h.Merge(oh)
+		r.Histogram = h.Export()
+	}
+
+	for phase := range o.Phases {
+		oh := o.PhaseHist(phase)
+		if oh == nil {
+			continue
+		}
+
+		h := r.PhaseHist(phase)
+		if h == nil {
+			h = hdrhistogram.New(oh.LowestTrackableValue(), oh.HighestTrackableValue(), int(oh.SignificantFigures()))
+
+			if r.phases == nil {
+				r.phases = map[string]*hdrhistogram.Histogram{}
+			}
+
+			r.phases[phase] = h
+		}
+
+		h.Merge(oh)
+
+		if r.Phases == nil {
+			r.Phases = map[string]*hdrhistogram.Snapshot{}
+		}
+
+		r.Phases[phase] = h.Export()
+	}
+
+	if r.StartTime.IsZero() || (!o.StartTime.IsZero() && o.StartTime.Before(r.StartTime)) {
+		r.StartTime = o.StartTime
+	}
+
+	if o.EndTime.After(r.EndTime) {
+		r.EndTime = o.EndTime
+	}
+
+	if !r.StartTime.IsZero() && !r.EndTime.IsZero() {
+		r.Time = r.EndTime.Sub(r.StartTime)
+	}
+
+	for i, s := range o.Stages {
+		if i >= len(r.Stages) {
+			r.Stages = append(r.Stages, Result{Name: s.Name})
+		}
+
+		r.Stages[i].merge(s)
+	}
+
+	for name, e := range o.Endpoints {
+		if r.Endpoints == nil {
+			r.Endpoints = map[string]*Result{}
+		}
+
+		if r.Endpoints[name] == nil {
+			r.Endpoints[name] = &Result{Name: name}
+		}
+
+		r.Endpoints[name].merge(*e)
+	}
+
+	r.mergeIntervals(o.Intervals)
+}
+
+// mergeIntervals merges intervals by their start time, which is aligned to
+// the wall clock, keeping r.Intervals sorted.
+func (r *Result) mergeIntervals(intervals []Result) {
+	if len(intervals) == 0 {
+		return
+	}
+
+	index := map[int64]int{}
+	for i, interval := range r.Intervals {
+		index[interval.StartTime.UnixNano()] = i
+	}
+
+	for _, oi := range intervals {
+		i, ok := index[oi.StartTime.UnixNano()]
+		if !ok {
+			r.Intervals = append(r.Intervals, Result{})
+			i = len(r.Intervals) - 1
+			index[oi.StartTime.UnixNano()] = i
+		}
+
+		r.Intervals[i].merge(oi)
+	}
+
+	sortIntervals(r.Intervals)
+}
+
+func sortIntervals(intervals []Result) {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].StartTime.Before(intervals[j].StartTime)
+	})
+}
+
+func (r *Result) record(item singleResult) {
+	if item.Dropped {
+		r.Dropped++
+		return
+	}
+
+	if item.Cancelled {
+		r.Cancelled++
+		return
+	}
+
+	r.Requests++
+	record(r.h, r.resolution(), item.Duration)
+
+	if item.Err {
+		r.Errors++
+	}
+
+	if item.Timeout {
+		r.Timeouts++
+	}
+
+	if item.Late {
+		r.Late++
+	}
+
+	if item.ExtractFailed {
+		r.ExtractionErrors++
+	}
+
+	if len(item.FailedAssertions) > 0 {
+		r.AssertionFailures++
+
+		if r.Assertions == nil {
+			r.Assertions = map[string]int{}
+		}
+
+		for _, name := range item.FailedAssertions {
+			r.Assertions[name]++
+		}
+	}
+
+	r.StatusCodes[item.StatusCode]++
+}
+
+// recordPhases adds the phase timings of item to the phase histograms, which
+// share the range of the latency histogram.
+func (r *Result) recordPhases(spec HistogramSpec, item singleResult) {
+	for phase, d := range item.Phases {
+		h, ok := r.phases[phase]
+		if !ok {
+			if r.phases == nil {
+				r.phases = map[string]*hdrhistogram.Histogram{}
+			}
+
+			h = spec.new()
+			r.phases[phase] = h
+		}
+
+		record(h, spec.Resolution, d)
+	}
+}
+
+// snapshot returns a copy of r with its histograms exported and its times set.
+// The copy shares no state with r, so r can keep recording. Stages, endpoints
+// and intervals are left for the caller to fill in.
+func (r *Result) snapshot(start, end time.Time) Result {
+	s := *r
+	s.h = nil
+	s.phases = nil
+	s.Stages = nil
+	s.Endpoints = nil
+	s.Intervals = nil
+
+	s.Histogram = r.h.Export()
+
+	s.StatusCodes = map[int]int{}
+	for k, v := range r.StatusCodes {
+		s.StatusCodes[k] = v
+	}
+
+	if r.Assertions != nil {
+		s.Assertions = map[string]int{}
+		for k, v := range r.Assertions {
+			s.Assertions[k] = v
+		}
+	}
+
+	s.Phases = nil
+	for phase, h := range r.phases {
+		if s.Phases == nil {
+			s.Phases = map[string]*hdrhistogram.Snapshot{}
+		}
+
+		s.Phases[phase] = h.Export()
+	}
+
+	s.StartTime = start
+	s.EndTime = end
+	s.Time = end.Sub(start)
+
+	return s
+}
@@ -0,0 +1,208 @@
+package bench_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestResultMergeMismatch(t *testing.T) {
+	a := bench.NewResult(bench.HistogramSpec{}.WithDefaults(time.Second))
+	b := bench.NewResult(bench.HistogramSpec{}.WithDefaults(time.Second))
+	c := bench.NewResult(bench.HistogramSpec{Resolution: time.Millisecond}.WithDefaults(time.Second))
+
+	b.Requests = 3
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("expected matching results to merge, got %s", err)
+	}
+
+	if a.Requests != 3 {
+		t.Errorf("expected 3 requests, got %d", a.Requests)
+	}
+
+	c.Requests = 5
+
+	if err := a.Merge(c); err != bench.ErrHistogramMismatch {
+		t.Errorf("expected a mismatch, got %v", err)
+	}
+
+	if a.Requests != 3 {
+		t.Errorf("expected a failed merge to leave the result unchanged, got %d requests", a.Requests)
+	}
+}
+
+func TestHistogramSpecValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  bench.HistogramSpec
+		valid bool
+	}{
+		{name: "defaults", valid: true},
+		{name: "default sigFigs", spec: bench.HistogramSpec{Resolution: time.Millisecond, SigFigs: 0}, valid: true},
+		{name: "most sigFigs", spec: bench.HistogramSpec{SigFigs: 5}, valid: true},
+		{name: "negative sigFigs", spec: bench.HistogramSpec{SigFigs: -1}},
+		{name: "too many sigFigs", spec: bench.HistogramSpec{SigFigs: 6}},
+		{name: "negative resolution", spec: bench.HistogramSpec{Resolution: -time.Millisecond}},
+		{name: "max below resolution", spec: bench.HistogramSpec{Resolution: time.Millisecond, Max: time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		if err := tt.spec.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", tt.name, tt.valid, err)
+		}
+	}
+
+	if s := (bench.HistogramSpec{}).WithDefaults(time.Second); s.SigFigs != bench.DefaultSigFigs {
+		t.Errorf("expected sigFigs 0 to default to %d, got %d", bench.DefaultSigFigs, s.SigFigs)
+	}
+}
+
+func TestRunnerLongTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2500 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	spec := bench.HistogramSpec{Resolution: time.Millisecond, SigFigs: 3}
+
+	r := bench.NewRunner(1, 100*time.Millisecond, 5*time.Second, srv.URL, nil, bench.WithHistogram(spec))
+
+	result := r.Run()
+
+	if result.Timeouts != 0 || result.StatusCodes[200] != 1 {
+		t.Fatalf("expected one successful request, got %+v", result)
+	}
+
+	if result.Resolution != time.Millisecond {
+		t.Errorf("expected a 1ms resolution, got %s", result.Resolution)
+	}
+
+	if max := result.Hist().Max(); max < 2500 || max > 2600 {
+		t.Errorf("expected a latency around 2500ms, got %dms", max)
+	}
+}
+
+func TestRunnerIntervals(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	interval := 100 * time.Millisecond
+
+	run := func() bench.Result {
+		r := bench.NewRunner(1, 350*time.Millisecond, 100*time.Millisecond, srv.URL, nil, bench.WithRate(40), bench.WithInterval(interval))
+		return r.Run()
+	}
+
+	a, b := run(), run()
+
+	if len(a.Intervals) < 4 {
+		t.Fatalf("expected at least 4 intervals, got %d", len(a.Intervals))
+	}
+
+	total := 0
+	for i, interval := range a.Intervals {
+		total += interval.Requests + interval.Dropped
+
+		if !interval.StartTime.Equal(interval.StartTime.Truncate(100 * time.Millisecond)) {
+			t.Errorf("interval %d: expected a wall clock aligned start, got %s", i, interval.StartTime)
+		}
+
+		if i > 0 && !interval.StartTime.After(a.Intervals[i-1].StartTime) {
+			t.Errorf("interval %d: expected intervals sorted by start time", i)
+		}
+	}
+
+	if total != a.Requests+a.Dropped {
+		t.Errorf("expected intervals to add up to %d sends, got %d", a.Requests+a.Dropped, total)
+	}
+
+	merged := bench.Result{}
+	if err := merged.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := merged.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := map[time.Time]int{}
+	for _, r := range []bench.Result{a, b} {
+		for _, interval := range r.Intervals {
+			buckets[interval.StartTime] += interval.Requests
+		}
+	}
+
+	if len(merged.Intervals) != len(buckets) {
+		t.Fatalf("expected %d merged intervals, got %d", len(buckets), len(merged.Intervals))
+	}
+
+	for _, interval := range merged.Intervals {
+		if interval.Requests != buckets[interval.StartTime] {
+			t.Errorf("%s: expected %d requests, got %d", interval.StartTime, buckets[interval.StartTime], interval.Requests)
+		}
+	}
+}
+
+func TestRunnerSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	r := bench.NewRunner(1, 400*time.Millisecond, 100*time.Millisecond, srv.URL, nil, bench.WithRate(50))
+
+	if before := r.Snapshot(); before.Requests != 0 {
+		t.Fatalf("expected an empty snapshot before the run, got %d requests", before.Requests)
+	}
+
+	done := make(chan bench.Result)
+	go func() {
+		done <- r.Run()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	partial := r.Snapshot()
+
+	final := <-done
+
+	if partial.Requests == 0 || partial.Requests >= final.Requests {
+		t.Errorf("expected a partial count below %d, got %d", final.Requests, partial.Requests)
+	}
+
+	if partial.Hist().TotalCount() != int64(partial.Requests) {
+		t.Errorf("expected the snapshot histogram to hold %d values, got %d", partial.Requests, partial.Hist().TotalCount())
+	}
+
+	if partial.Time <= 0 || partial.Time >= final.Time {
+		t.Errorf("expected a partial run time, got %s", partial.Time)
+	}
+}
+
+func TestRunnerClockOffset(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	offset := time.Hour + 30*time.Millisecond
+
+	r := bench.NewRunner(1, 200*time.Millisecond, 100*time.Millisecond, srv.URL, nil, bench.WithRate(20), bench.WithInterval(100*time.Millisecond), bench.WithClockOffset(offset))
+
+	before := time.Now()
+	result := r.Run()
+
+	if shift := result.StartTime.Sub(before); shift < offset || shift > offset+100*time.Millisecond {
+		t.Errorf("expected the start time to be shifted by %s, got %s", offset, shift)
+	}
+
+	for _, interval := range result.Intervals {
+		if !interval.StartTime.Equal(interval.StartTime.Truncate(100 * time.Millisecond)) {
+			t.Errorf("expected intervals aligned on the shifted clock, got %s", interval.StartTime)
+		}
+
+		if interval.StartTime.Before(result.StartTime.Add(-100 * time.Millisecond)) {
+			t.Errorf("expected intervals on the shifted clock, got %s for a run starting at %s", interval.StartTime, result.StartTime)
+		}
+	}
+}
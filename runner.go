@@ -1,15 +1,16 @@
 package bench
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
-
-	"github.com/codahale/hdrhistogram"
 )
 
 type Replacer interface {
@@ -27,11 +28,23 @@ type Runner struct {
 	runnerID string
 
 	concurrency int
+	rate        float64
+	stages      []Stage
 	duration    time.Duration
 	timeout     time.Duration
-	url         string
+	histogram   HistogramSpec
+	interval    time.Duration
+	request     RequestSpec
+	scenario    *Scenario
+	mix         []RequestSpec
+	totalWeight int
+	feeder      *Feeder
+	replay      *Replay
 	replacer    Replacer
 
+	cancelInFlight bool
+	clockOffset    time.Duration
+
 	wg sync.WaitGroup
 
 	startTime time.Time
@@ -39,24 +52,120 @@ type Runner struct {
 
 	runOutput chan singleResult
 
-	result Result
+	// mu guards the results collected so far, which Snapshot reads while the
+	// run is in progress.
+	mu        sync.Mutex
+	collected *Result
+	intervals map[int64]*Result
+}
+
+// RunnerOption configures optional Runner behavior.
+type RunnerOption func(*Runner)
+
+// WithRate switches the Runner to an open model, where requests are scheduled
+// at a constant rate (requests per second) across the worker pool instead of
+// each worker sending its next request as soon as the previous one returns.
+// Latency is measured from the intended send time, so a slow target is not
+// rewarded with less load.
+func WithRate(rate float64) RunnerOption {
+	return func(r *Runner) {
+		r.rate = rate
+	}
+}
+
+// WithStages runs a load profile instead of a flat load. The run lasts for the
+// total duration of the stages, and the concurrency passed to NewRunner is
+// raised to the peak stage concurrency if needed. For rate driven stages the
+// concurrency is the size of the worker pool.
+func WithStages(stages []Stage) RunnerOption {
+	return func(r *Runner) {
+		r.stages = stages
+	}
+}
+
+// WithRequest sends the request described by spec instead of a GET to the url
+// passed to NewRunner. The url is still used if the spec has none.
+func WithRequest(spec RequestSpec) RunnerOption {
+	return func(r *Runner) {
+		url := r.request.URL
+		r.request = spec
+
+		if r.request.URL == "" {
+			r.request.URL = url
+		}
+	}
+}
+
+// WithScenario runs the steps of the scenario in order on every iteration
+// instead of a single request. Results are broken down per step in
+// Result.Endpoints.
+func WithScenario(s Scenario) RunnerOption {
+	return func(r *Runner) {
+		r.scenario = &s
+	}
+}
+
+// WithMix picks one of the requests on every iteration, in proportion to their
+// weights. Results are broken down per request name in Result.Endpoints.
+func WithMix(specs []RequestSpec) RunnerOption {
+	return func(r *Runner) {
+		r.mix = specs
+	}
+}
+
+// WithFeeder binds a row of the feeder to each virtual user at the start of
+// every iteration, substituting {column} placeholders in its requests.
+func WithFeeder(f *Feeder) RunnerOption {
+	return func(r *Runner) {
+		r.feeder = f
+	}
 }
 
-func (r *Result) Hist() *hdrhistogram.Histogram {
-	if r.h != nil {
-		return r.h
+// WithReplay sends the requests of an access log instead of the configured
+// request. A timed replay ends with the log or the duration, whichever comes
+// first.
+func WithReplay(rp *Replay) RunnerOption {
+	return func(r *Runner) {
+		r.replay = rp
 	}
+}
 
-	if r.Histogram != nil {
-		r.h = hdrhistogram.Import(r.Histogram)
-		return r.h
+// WithHistogram sets the range and precision of the latency histograms. Unset
+// fields fall back to the defaults of HistogramSpec.WithDefaults.
+func WithHistogram(spec HistogramSpec) RunnerOption {
+	return func(r *Runner) {
+		r.histogram = spec
 	}
+}
 
-	return nil
+// WithInterval sets the length of the buckets of Result.Intervals. Buckets are
+// aligned to the wall clock, so the intervals of different runners line up.
+func WithInterval(d time.Duration) RunnerOption {
+	return func(r *Runner) {
+		r.interval = d
+	}
+}
+
+// WithCancelInFlight cancels the requests still in flight when the run
+// stops, at the end of its duration or when its context is done, instead of
+// waiting up to the timeout for them. They are counted in Result.Cancelled.
+func WithCancelInFlight() RunnerOption {
+	return func(r *Runner) {
+		r.cancelInFlight = true
+	}
 }
 
-func NewRunner(concurrency int, duration, timeout time.Duration, url string, replacer Replacer) *Runner {
-	if timeout == 0 || timeout > 2*time.Second {
+// WithClockOffset shifts the times in the result by d, the difference between
+// a reference clock and the local one, so the results and intervals of
+// runners on machines with skewed clocks line up.
+func WithClockOffset(d time.Duration) RunnerOption {
+	return func(r *Runner) {
+		r.clockOffset = d
+	}
+}
+
+func NewRunner(concurrency int, duration, timeout time.Duration, url string, replacer Replacer, opts ...RunnerOption) *Runner {
+	if timeout == 0 {
 		timeout = 2 * time.Second
 	}
 
@@ -64,18 +173,85 @@ func NewRunner(concurrency int, duration, timeout time.Duration, url string, rep
 		replacer = noopReplacer{}
 	}
 
-	return &Runner{
+	r := &Runner{
 		concurrency: concurrency,
 		duration:    duration,
 		timeout:     timeout,
-		url:         url,
+		request:     RequestSpec{URL: url},
 		replacer:    replacer,
 		runOutput:   make(chan singleResult, 1000),
 	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.interval <= 0 {
+		r.interval = DefaultInterval
+	}
+
+	if r.scenario != nil {
+		steps := make([]RequestSpec, len(r.scenario.Steps))
+
+		for i, step := range r.scenario.Steps {
+			if step.Name == "" {
+				step.Name = strconv.Itoa(i)
+			}
+
+			steps[i] = step.compile()
+		}
+
+		r.scenario = &Scenario{Name: r.scenario.Name, Steps: steps}
+	} else if len(r.mix) > 0 {
+		mix := make([]RequestSpec, len(r.mix))
+
+		for i, spec := range r.mix {
+			if spec.Name == "" {
+				spec.Name = strconv.Itoa(i)
+			}
+
+			if spec.Weight <= 0 {
+				spec.Weight = 1
+			}
+
+			r.totalWeight += spec.Weight
+			mix[i] = spec.compile()
+		}
+
+		r.mix = mix
+	} else {
+		r.request = r.request.compile()
+	}
+
+	if len(r.stages) > 0 {
+		r.duration = StagesDuration(r.stages)
+
+		if peak := StagesPeakConcurrency(r.stages); peak > r.concurrency {
+			r.concurrency = peak
+		}
+	}
+
+	r.histogram = r.histogram.WithDefaults(DefaultMax(timeout, r.duration, r.rateDriven()))
+
+	return r
 }
 
 func (r *Runner) Run() Result {
+	return r.RunContext(context.Background())
+}
+
+// RunContext runs like Run, but stops early when ctx is done. No request is
+// started after the run stops, whether at the end of its duration or because
+// ctx is done; requests in flight are waited for, or cancelled with
+// WithCancelInFlight. The result covers the run up to the point it stopped.
+func (r *Runner) RunContext(ctx context.Context) Result {
+	r.mu.Lock()
 	r.startTime = time.Now()
+	r.collect()
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithDeadline(ctx, r.startTime.Add(r.duration))
+	defer cancel()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -86,8 +262,22 @@ func (r *Runner) Run() Result {
 
 	r.wg.Add(r.concurrency)
 
-	for i := 0; i < r.concurrency; i++ {
-		go r.run(i)
+	if r.rateDriven() {
+		sends := make(chan scheduledSend, r.concurrency)
+
+		if r.replay != nil && r.replay.timed() {
+			go r.scheduleReplay(ctx, sends)
+		} else {
+			go r.schedule(ctx, sends)
+		}
+
+		for i := 0; i < r.concurrency; i++ {
+			go r.runScheduled(ctx, i, sends)
+		}
+	} else {
+		for i := 0; i < r.concurrency; i++ {
+			go r.run(ctx, i)
+		}
 	}
 
 	// Wait for our concurrent runners to finish.
@@ -95,62 +285,374 @@ func (r *Runner) Run() Result {
 
 	close(r.runOutput)
 
+	r.mu.Lock()
 	r.endTime = time.Now()
+	r.mu.Unlock()
 
 	// Wait for combineResults to finish.
 	wg.Wait()
 
-	return r.result
+	return r.Snapshot()
+}
+
+// Snapshot returns the results collected so far. It is safe to call while the
+// run is in progress, in which case the results end at the current time. It
+// returns an empty Result before the run starts.
+func (r *Runner) Snapshot() Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.collected == nil {
+		return Result{}
+	}
+
+	end := r.endTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	start := r.startTime.Add(r.clockOffset)
+	end = end.Add(r.clockOffset)
+
+	result := r.collected.snapshot(start, end)
+
+	// Stages that have not finished yet, or not started, end at end.
+	stageStart := start
+	for i, s := range r.stages {
+		from, to := stageStart, stageStart.Add(s.Duration)
+		if from.After(end) {
+			from = end
+		}
+
+		if to.After(end) {
+			to = end
+		}
+
+		result.Stages = append(result.Stages, r.collected.Stages[i].snapshot(from, to))
+		stageStart = stageStart.Add(s.Duration)
+	}
+
+	for name, e := range r.collected.Endpoints {
+		if result.Endpoints == nil {
+			result.Endpoints = map[string]*Result{}
+		}
+
+		endpoint := e.snapshot(start, end)
+		result.Endpoints[name] = &endpoint
+	}
+
+	for bucket, interval := range r.intervals {
+		from := time.Unix(0, bucket)
+		result.Intervals = append(result.Intervals, interval.snapshot(from, from.Add(r.interval)))
+	}
+
+	sortIntervals(result.Intervals)
+
+	return result
 }
 
-func (r *Runner) run(index int) {
-	runStart := time.Now()
+// idleStep is how long a worker or the scheduler waits before checking the
+// load profile again while it has nothing to do.
+const idleStep = 10 * time.Millisecond
+
+func (r *Runner) run(ctx context.Context, index int) {
+	vu := newVirtualUser(index, r.replacer)
 
-	for time.Now().Sub(runStart) < r.duration {
-		r.doRequest()
+	for ctx.Err() == nil {
+		elapsed := time.Now().Sub(r.startTime)
+
+		if index >= r.concurrencyAt(elapsed) {
+			sleepUntil(ctx, time.Now().Add(idleStep))
+			continue
+		}
+
+		r.iterate(ctx, vu, scheduledSend{stage: r.stageIndex(elapsed)})
 	}
 
 	r.wg.Done()
 }
 
-type singleResult struct {
-	StatusCode                  int
-	DurationHundredMicroSeconds int
-	Bytes                       int
-	Timeout                     bool
-	Err                         bool
+func (r *Runner) rateDriven() bool {
+	return r.rate > 0 || StagesUseRate(r.stages) || (r.replay != nil && r.replay.timed())
+}
+
+func (r *Runner) concurrencyAt(elapsed time.Duration) int {
+	if len(r.stages) == 0 {
+		return r.concurrency
+	}
+
+	return int(math.Round(stageLevel(r.stages, elapsed, stageConcurrency)))
 }
 
-func hundredMicroSeconds(d time.Duration) int {
-	us := int(d / time.Microsecond)
-	return int(math.Round(float64(us / 100)))
+func (r *Runner) rateAt(elapsed time.Duration) float64 {
+	if len(r.stages) == 0 {
+		return r.rate
+	}
+
+	return stageLevel(r.stages, elapsed, stageRate)
+}
+
+func (r *Runner) stageIndex(elapsed time.Duration) int {
+	if len(r.stages) == 0 {
+		return 0
+	}
+
+	i, _ := stageAt(r.stages, elapsed)
+
+	return i
+}
+
+type scheduledSend struct {
+	// intended is when the request should have been sent. It is zero outside
+	// of rate mode.
+	intended time.Time
+	// interval is the time until the next scheduled send; a request that
+	// starts later than that is counted as late.
+	interval time.Duration
+	stage    int
+	// spec is the request to send, for sends that carry their own.
+	spec *RequestSpec
+}
+
+// schedule emits every send in rate mode. When every worker is busy and the
+// queue is full, the send is dropped rather than delayed, so the schedule
+// never slows down to match the target.
+func (r *Runner) schedule(ctx context.Context, sends chan<- scheduledSend) {
+	defer close(sends)
+
+	// The offset is kept as float nanoseconds so rounding does not accumulate
+	// over a long run.
+	var offset float64
+
+	for time.Duration(math.Round(offset)) < r.duration {
+		elapsed := time.Duration(math.Round(offset))
+
+		rate := r.rateAt(elapsed)
+		if rate <= 0 {
+			offset += float64(idleStep)
+			continue
+		}
+
+		interval := float64(time.Second) / rate
+		offset += interval
+
+		send := scheduledSend{
+			intended: r.startTime.Add(elapsed),
+			interval: time.Duration(interval),
+			stage:    r.stageIndex(elapsed),
+		}
+
+		if !sleepUntil(ctx, send.intended) {
+			return
+		}
+
+		select {
+		case sends <- send:
+		default:
+			r.runOutput <- singleResult{Dropped: true, Stage: send.stage, At: send.intended}
+		}
+	}
+}
+
+// scheduleReplay emits the entries of the access log at their recorded
+// offsets, scaled by the replay speed.
+func (r *Runner) scheduleReplay(ctx context.Context, sends chan<- scheduledSend) {
+	defer close(sends)
+
+	for i := range r.replay.specs {
+		offset := r.replay.offset(i)
+		if offset >= r.duration {
+			return
+		}
+
+		// Entries that follow each other closely are only late once they slip
+		// by more than idleStep.
+		interval := idleStep
+		if i+1 < len(r.replay.specs) {
+			if gap := r.replay.offset(i+1) - offset; gap > interval {
+				interval = gap
+			}
+		}
+
+		send := scheduledSend{
+			intended: r.startTime.Add(offset),
+			interval: interval,
+			stage:    r.stageIndex(offset),
+			spec:     &r.replay.specs[i],
+		}
+
+		if !sleepUntil(ctx, send.intended) {
+			return
+		}
+
+		select {
+		case sends <- send:
+		default:
+			r.runOutput <- singleResult{Dropped: true, Stage: send.stage, At: send.intended}
+		}
+	}
+}
+
+func (r *Runner) runScheduled(ctx context.Context, index int, sends <-chan scheduledSend) {
+	vu := newVirtualUser(index, r.replacer)
+
+	for send := range sends {
+		// Sends still queued when the run stops are never made.
+		if ctx.Err() != nil {
+			r.runOutput <- singleResult{Dropped: true, Stage: send.stage, At: send.intended}
+			continue
+		}
+
+		r.iterate(ctx, vu, send)
+	}
+
+	r.wg.Done()
+}
+
+// sleepUntil waits for t, reporting false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+type singleResult struct {
+	StatusCode       int
+	Duration         time.Duration
+	Bytes            int
+	Timeout          bool
+	Err              bool
+	Dropped          bool
+	Cancelled        bool
+	Late             bool
+	ExtractFailed    bool
+	FailedAssertions []string
+	Phases           map[string]time.Duration
+	Stage            int
+	Name             string
+	// At is when the request was sent, or was meant to be sent in rate mode.
+	At time.Time
 }
 
 type Timeout interface {
 	Timeout() bool
 }
 
-func (r *Runner) doRequest() {
-	var result singleResult
+// pick chooses a request from the mix according to the weights.
+func (r *Runner) pick() RequestSpec {
+	n := rand.Intn(r.totalWeight)
+
+	for _, spec := range r.mix {
+		if n < spec.Weight {
+			return spec
+		}
+
+		n -= spec.Weight
+	}
+
+	return r.mix[len(r.mix)-1]
+}
+
+// iterate runs one iteration for a virtual user: the next access log entry, a
+// request picked from the mix, the single request, or every step of the
+// scenario, stopping at the first step that fails.
+func (r *Runner) iterate(ctx context.Context, vu *virtualUser, send scheduledSend) {
+	if r.feeder != nil {
+		for k, v := range r.feeder.Next() {
+			vu.vars[k] = v
+		}
+	}
+
+	if send.spec != nil {
+		r.doRequest(ctx, vu, *send.spec, send)
+		return
+	}
+
+	if r.replay != nil {
+		r.doRequest(ctx, vu, r.replay.next(), send)
+		return
+	}
+
+	if len(r.mix) > 0 {
+		r.doRequest(ctx, vu, r.pick(), send)
+		return
+	}
+
+	if r.scenario == nil {
+		r.doRequest(ctx, vu, r.request, send)
+		return
+	}
+
+	for i, step := range r.scenario.Steps {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if i > 0 {
+			// Only the first step of an iteration is scheduled; later ones
+			// follow as soon as the previous step returns.
+			send = scheduledSend{stage: send.stage}
+		}
+
+		if !r.doRequest(ctx, vu, step, send) {
+			return
+		}
+	}
+}
+
+// doRequest sends a single request, checks its assertions and stores any
+// extracted values on the virtual user. In rate mode, latency is measured from
+// the intended send time instead of the actual one. It reports whether the
+// request succeeded.
+func (r *Runner) doRequest(ctx context.Context, vu *virtualUser, spec RequestSpec, send scheduledSend) bool {
+	result := singleResult{
+		Stage: send.stage,
+		Name:  spec.Name,
+		At:    time.Now(),
+	}
 	defer func() {
 		r.runOutput <- result
 	}()
 
-	url := r.replacer.Replace(r.url)
-
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := spec.NewRequest(vu)
 	if err != nil {
 		result.Err = true
-		return
+		return false
 	}
 
-	ctx, cancel := context.WithTimeout(req.Context(), r.timeout)
+	parent := req.Context()
+	if r.cancelInFlight {
+		parent = ctx
+	}
+
+	reqCtx, cancel := context.WithTimeout(parent, r.timeout)
 	defer cancel()
-	req = req.WithContext(ctx)
+	req = req.WithContext(reqCtx)
+
+	var timer phaseTimer
+	req = timer.trace(req)
 
 	start := time.Now()
 
+	if !send.intended.IsZero() {
+		result.Late = start.Sub(send.intended) > send.interval
+		start = send.intended
+	}
+
+	result.At = start
+
 	resp, err := http.DefaultClient.Do(req)
+	if err != nil && r.cancelInFlight && ctx.Err() != nil {
+		result.Cancelled = true
+		return false
+	}
+
 	if err != nil {
 		result.Err = true
 		if t, ok := err.(Timeout); ok {
@@ -158,45 +660,121 @@ func (r *Runner) doRequest() {
 		}
 	}
 
+	var body bytes.Buffer
+
 	if resp != nil {
 		result.StatusCode = resp.StatusCode
 
 		if resp.Body != nil {
-			n, _ := io.Copy(ioutil.Discard, resp.Body)
+			// Only keep the body around when something needs to read it.
+			var w io.Writer = ioutil.Discard
+			if spec.needsBody() {
+				w = &body
+			}
+
+			n, err := io.Copy(w, resp.Body)
 			result.Bytes = int(n)
 			resp.Body.Close()
+
+			if err != nil && r.cancelInFlight && ctx.Err() != nil {
+				result.Cancelled = true
+				return false
+			}
 		}
 	}
 
-	result.DurationHundredMicroSeconds = hundredMicroSeconds(time.Now().Sub(start))
-}
+	end := time.Now()
+	result.Duration = end.Sub(start)
+	result.Phases = timer.phases(end)
 
-func (r *Runner) combineResults() {
-	result := Result{
-		StatusCodes: map[int]int{},
-		h:           hdrhistogram.New(0, int64(hundredMicroSeconds(r.timeout)), 2),
+	if result.Err {
+		return false
 	}
 
-	for item := range r.runOutput {
-		result.Requests++
-		result.h.RecordValue(int64(item.DurationHundredMicroSeconds))
+	for _, a := range spec.Assertions {
+		if !a.check(resp, body.Bytes(), result.Bytes) {
+			result.FailedAssertions = append(result.FailedAssertions, a.Name)
+		}
+	}
+
+	if len(result.FailedAssertions) > 0 {
+		return false
+	}
 
-		if item.Err {
-			result.Errors++
+	for _, e := range spec.Extract {
+		v, ok := e.extract(resp, body.Bytes())
+		if !ok {
+			result.ExtractFailed = true
+			return false
 		}
 
-		if item.Timeout {
-			result.Timeouts++
+		vu.vars[e.Name] = v
+	}
+
+	return true
+}
+
+// collect sets up the results of a new run. r.mu must be held.
+func (r *Runner) collect() {
+	result := NewResult(r.histogram)
+
+	for i, s := range r.stages {
+		stage := NewResult(r.histogram)
+		stage.Name = s.Name
+		if stage.Name == "" {
+			stage.Name = strconv.Itoa(i)
 		}
 
-		result.StatusCodes[item.StatusCode]++
+		result.Stages = append(result.Stages, stage)
 	}
 
-	result.Histogram = result.h.Export()
+	r.collected = &result
+	r.intervals = map[int64]*Result{}
+}
 
-	result.StartTime = r.startTime
-	result.EndTime = r.endTime
-	result.Time = r.endTime.Sub(r.startTime)
+func (r *Runner) combineResults() {
+	for item := range r.runOutput {
+		r.mu.Lock()
+		r.combine(item)
+		r.mu.Unlock()
+	}
+}
 
-	r.result = result
+// combine adds item to the results collected so far. r.mu must be held.
+func (r *Runner) combine(item singleResult) {
+	result := r.collected
+
+	result.record(item)
+	result.recordPhases(r.histogram, item)
+
+	bucket := item.At.Add(r.clockOffset).Truncate(r.interval).UnixNano()
+
+	interval, ok := r.intervals[bucket]
+	if !ok {
+		i := NewResult(r.histogram)
+		interval = &i
+		r.intervals[bucket] = interval
+	}
+
+	interval.record(item)
+
+	if item.Stage < len(result.Stages) {
+		result.Stages[item.Stage].record(item)
+	}
+
+	if item.Name != "" {
+		if result.Endpoints == nil {
+			result.Endpoints = map[string]*Result{}
+		}
+
+		e := result.Endpoints[item.Name]
+		if e == nil {
+			endpoint := NewResult(r.histogram)
+			endpoint.Name = item.Name
+			e = &endpoint
+			result.Endpoints[item.Name] = e
+		}
+
+		e.record(item)
+	}
 }
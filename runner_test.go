@@ -1,8 +1,14 @@
 package bench_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,7 +16,7 @@ import (
 )
 
 func TestRunner(t *testing.T) {
-	r := bench.NewRunner(2, 2*time.Second, 60*time.Millisecond, "https://www.google.com/?test=")
+	r := bench.NewRunner(2, 2*time.Second, 60*time.Millisecond, "https://www.google.com/?test=", nil)
 
 	results := r.Run()
 
@@ -20,3 +26,288 @@ func TestRunner(t *testing.T) {
 
 	t.Fail()
 }
+
+func TestRunnerRate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	r := bench.NewRunner(4, time.Second, 100*time.Millisecond, srv.URL, nil, bench.WithRate(50))
+
+	result := r.Run()
+
+	if result.Requests+result.Dropped != 50 {
+		t.Errorf("expected 50 scheduled sends, got %d requests and %d dropped", result.Requests, result.Dropped)
+	}
+
+	if result.StatusCodes[200] != result.Requests {
+		t.Errorf("expected all requests to return 200, got %v", result.StatusCodes)
+	}
+
+	// Requests may be queued for the whole run, so latency may exceed the
+	// timeout.
+	if max := time.Duration(result.Hist().HighestTrackableValue()) * result.Resolution; max < 1100*time.Millisecond {
+		t.Errorf("expected the histogram to reach the timeout plus the duration, got %s", max)
+	}
+}
+
+func TestRunnerStages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	stages := []bench.Stage{
+		{Name: "warmup", Duration: 500 * time.Millisecond, Rate: 20},
+		{Name: "spike", Duration: 500 * time.Millisecond, Rate: 60},
+	}
+
+	r := bench.NewRunner(4, 0, 100*time.Millisecond, srv.URL, nil, bench.WithStages(stages))
+
+	result := r.Run()
+
+	if len(result.Stages) != 2 {
+		t.Fatalf("expected 2 stages, got %d", len(result.Stages))
+	}
+
+	for i, want := range []int{10, 30} {
+		s := result.Stages[i]
+		if s.Name != stages[i].Name {
+			t.Errorf("stage %d: expected name %q, got %q", i, stages[i].Name, s.Name)
+		}
+
+		if got := s.Requests + s.Dropped; got != want {
+			t.Errorf("stage %d: expected %d scheduled sends, got %d", i, want, got)
+		}
+	}
+}
+
+type fixedReplacer string
+
+func (f fixedReplacer) Replace(s string) string {
+	return strings.Replace(s, "{id}", string(f), -1)
+}
+
+func TestRunnerRequestSpec(t *testing.T) {
+	var mu sync.Mutex
+	var got *http.Request
+	var gotBody string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		got = r
+		gotBody = string(body)
+		mu.Unlock()
+
+		w.WriteHeader(201)
+	}))
+	defer srv.Close()
+
+	spec := bench.RequestSpec{
+		Method:  http.MethodPost,
+		URL:     srv.URL + "/items/{id}",
+		Headers: map[string]string{"X-Item": "{id}"},
+		Query:   map[string]string{"q": "{id}"},
+		Body:    `{"id":"{id}"}`,
+	}
+
+	r := bench.NewRunner(1, 100*time.Millisecond, 100*time.Millisecond, "", fixedReplacer("42"), bench.WithRequest(spec))
+
+	result := r.Run()
+
+	if result.StatusCodes[201] == 0 {
+		t.Fatalf("expected 201 responses, got %v", result.StatusCodes)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if got.Method != http.MethodPost || got.URL.Path != "/items/42" || got.URL.Query().Get("q") != "42" {
+		t.Errorf("unexpected request %s %s", got.Method, got.URL)
+	}
+
+	if got.Header.Get("X-Item") != "42" {
+		t.Errorf("expected header to be replaced, got %q", got.Header.Get("X-Item"))
+	}
+
+	if gotBody != `{"id":"42"}` {
+		t.Errorf("expected body to be replaced, got %q", gotBody)
+	}
+}
+
+func TestRunnerScenario(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("X-Session", "abc")
+			w.Write([]byte(`{"data":{"token":"t0k3n","account":5000000}}`))
+		case "/items":
+			if r.Header.Get("Authorization") != "Bearer t0k3n" || r.URL.Query().Get("session") != "abc" || r.URL.Query().Get("account") != "5000000" {
+				w.WriteHeader(401)
+				return
+			}
+
+			w.Write([]byte(`<a href="/items/17">item</a>`))
+		case "/items/17":
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	scenario := bench.Scenario{
+		Steps: []bench.RequestSpec{
+			{
+				Name: "login",
+				URL:  srv.URL + "/login",
+				Extract: []bench.Extraction{
+					{Name: "token", Source: bench.ExtractJSON, Expression: "data.token"},
+					{Name: "session", Source: bench.ExtractHeader, Expression: "X-Session"},
+					{Name: "account", Source: bench.ExtractJSON, Expression: "data.account"},
+				},
+			},
+			{
+				Name:    "list",
+				URL:     srv.URL + "/items?session={session}&account={account}",
+				Headers: map[string]string{"Authorization": "Bearer {token}"},
+				Extract: []bench.Extraction{
+					{Name: "item", Source: bench.ExtractRegex, Expression: `href="/items/(\d+)"`},
+				},
+			},
+			{
+				Name: "detail",
+				URL:  srv.URL + "/items/{item}",
+			},
+		},
+	}
+
+	if err := scenario.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bench.NewRunner(1, 100*time.Millisecond, 100*time.Millisecond, "", nil, bench.WithScenario(scenario))
+
+	result := r.Run()
+
+	for name, code := range map[string]int{"login": 200, "list": 200, "detail": 204} {
+		e := result.Endpoints[name]
+		if e == nil || e.Requests == 0 {
+			t.Fatalf("expected requests for step %s", name)
+		}
+
+		if e.StatusCodes[code] != e.Requests {
+			t.Errorf("step %s: expected all %d, got %v", name, code, e.StatusCodes)
+		}
+	}
+
+	if result.ExtractionErrors != 0 {
+		t.Errorf("expected no extraction errors, got %d", result.ExtractionErrors)
+	}
+}
+
+func TestRunnerMix(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(201)
+		}
+	}))
+	defer srv.Close()
+
+	mix := []bench.RequestSpec{
+		{Name: "items", URL: srv.URL + "/items/1", Weight: 7},
+		{Name: "search", URL: srv.URL + "/search", Weight: 2},
+		{Name: "cart", Method: http.MethodPost, URL: srv.URL + "/cart", Weight: 1},
+	}
+
+	if err := bench.ValidateMix(mix); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bench.NewRunner(2, 300*time.Millisecond, 100*time.Millisecond, "", nil, bench.WithMix(mix))
+
+	result := r.Run()
+
+	total := 0
+	for _, spec := range mix {
+		e := result.Endpoints[spec.Name]
+		if e == nil || e.Requests == 0 {
+			t.Fatalf("expected requests for %s", spec.Name)
+		}
+
+		total += e.Requests
+	}
+
+	if total != result.Requests {
+		t.Errorf("expected endpoints to add up to %d requests, got %d", result.Requests, total)
+	}
+
+	if result.Endpoints["cart"].StatusCodes[201] != result.Endpoints["cart"].Requests {
+		t.Errorf("expected cart requests to be POSTs, got %v", result.Endpoints["cart"].StatusCodes)
+	}
+
+	if result.Endpoints["items"].Requests < result.Endpoints["cart"].Requests {
+		t.Errorf("expected items to be picked more often than cart")
+	}
+}
+
+func TestRunnerContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, opts := range [][]bench.RunnerOption{nil, {bench.WithRate(50)}} {
+		r := bench.NewRunner(2, 5*time.Second, 100*time.Millisecond, srv.URL, nil, opts...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+
+		start := time.Now()
+		result := r.RunContext(ctx)
+		cancel()
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected the run to stop when cancelled, took %s", elapsed)
+		}
+
+		if result.Requests == 0 {
+			t.Errorf("expected the requests made before cancelling to be reported")
+		}
+
+		if result.Time > time.Second {
+			t.Errorf("expected the result to end when cancelled, got %s", result.Time)
+		}
+	}
+}
+
+func TestRunnerCancelInFlight(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	r := bench.NewRunner(2, 200*time.Millisecond, 5*time.Second, srv.URL, nil)
+
+	result := r.Run()
+
+	if result.Requests != 2 || result.Cancelled != 0 {
+		t.Errorf("expected in flight requests to be waited for, got %d requests and %d cancelled", result.Requests, result.Cancelled)
+	}
+
+	r = bench.NewRunner(2, 200*time.Millisecond, 5*time.Second, srv.URL, nil, bench.WithCancelInFlight())
+
+	start := time.Now()
+	result = r.Run()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the run to end at its deadline, took %s", elapsed)
+	}
+
+	if result.Requests != 0 || result.Cancelled != 2 {
+		t.Errorf("expected in flight requests to be cancelled, got %d requests and %d cancelled", result.Requests, result.Cancelled)
+	}
+}
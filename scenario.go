@@ -0,0 +1,176 @@
+package bench
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Extraction sources.
+const (
+	ExtractJSON   = "json"
+	ExtractRegex  = "regex"
+	ExtractHeader = "header"
+)
+
+// Validate checks every step of the scenario and its extractions.
+func (s Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("scenario must have at least one step")
+	}
+
+	for i, step := range s.Steps {
+		err := step.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "step %d", i)
+		}
+
+		for _, e := range step.Extract {
+			err = e.Validate()
+			if err != nil {
+				return errors.Wrapf(err, "step %d", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e Extraction) Validate() error {
+	if e.Name == "" {
+		return errors.New("extraction name must not be empty")
+	}
+
+	switch e.Source {
+	case ExtractJSON, ExtractHeader:
+	case ExtractRegex:
+		_, err := regexp.Compile(e.Expression)
+		if err != nil {
+			return errors.Wrapf(err, "extraction %s", e.Name)
+		}
+	default:
+		return errors.Errorf("extraction %s: unknown source %q", e.Name, e.Source)
+	}
+
+	return nil
+}
+
+// extract pulls the value described by e out of a response. It reports false
+// when the value is not present.
+func (e Extraction) extract(resp *http.Response, body []byte) (string, bool) {
+	switch e.Source {
+	case ExtractHeader:
+		v := resp.Header.Get(e.Expression)
+		return v, v != ""
+	case ExtractRegex:
+		if e.re == nil {
+			return "", false
+		}
+
+		m := e.re.FindSubmatch(body)
+		if m == nil {
+			return "", false
+		}
+
+		// Use the first group if there is one, otherwise the whole match.
+		if len(m) > 1 {
+			return string(m[1]), true
+		}
+
+		return string(m[0]), true
+	case ExtractJSON:
+		var doc interface{}
+		if json.Unmarshal(body, &doc) != nil {
+			return "", false
+		}
+
+		return jsonPath(doc, e.Expression)
+	}
+
+	return "", false
+}
+
+// jsonPath looks up a dotted path such as "data.items[0].id" in a decoded
+// JSON document. A leading "$." is ignored.
+func jsonPath(doc interface{}, path string) (string, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	if path != "" {
+		for _, part := range strings.Split(strings.Replace(path, "[", ".[", -1), ".") {
+			if part == "" {
+				continue
+			}
+
+			if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
+				i, err := strconv.Atoi(part[1 : len(part)-1])
+				arr, ok := doc.([]interface{})
+				if err != nil || !ok || i < 0 || i >= len(arr) {
+					return "", false
+				}
+
+				doc = arr[i]
+				continue
+			}
+
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+
+			doc, ok = obj[part]
+			if !ok {
+				return "", false
+			}
+		}
+	}
+
+	switch v := doc.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		// Formatted without an exponent, so large ids come out whole.
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+
+		return string(data), true
+	}
+}
+
+// virtualUser holds the state of one worker: the variables extracted from
+// earlier responses, which are substituted as {name} before the Runner's
+// Replacer is applied.
+type virtualUser struct {
+	vars     map[string]string
+	replacer Replacer
+}
+
+func newVirtualUser(index int, replacer Replacer) *virtualUser {
+	if ur, ok := replacer.(UserReplacer); ok {
+		replacer = ur.ForUser(index)
+	}
+
+	return &virtualUser{
+		vars:     map[string]string{},
+		replacer: replacer,
+	}
+}
+
+func (vu *virtualUser) Replace(s string) string {
+	for k, v := range vu.vars {
+		s = strings.Replace(s, "{"+k+"}", v, -1)
+	}
+
+	return vu.replacer.Replace(s)
+}
@@ -0,0 +1,159 @@
+package bench
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UnmarshalJSON accepts the stage duration either as nanoseconds or as a
+// duration string such as "2m30s".
+func (s *Stage) UnmarshalJSON(data []byte) error {
+	type stage Stage
+
+	aux := struct {
+		*stage
+		Duration interface{} `json:"duration"`
+	}{
+		stage: (*stage)(s),
+	}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	s.Duration, err = jsonDuration(aux.Duration)
+	if err != nil {
+		return errors.Wrap(err, "error parsing stage duration")
+	}
+
+	return nil
+}
+
+// jsonDuration converts a decoded JSON value, either nanoseconds or a duration
+// string, to a time.Duration.
+func jsonDuration(v interface{}) (time.Duration, error) {
+	switch d := v.(type) {
+	case float64:
+		return time.Duration(d), nil
+	case string:
+		return time.ParseDuration(d)
+	case nil:
+		return 0, nil
+	}
+
+	return 0, errors.New("duration must be a number or a string")
+}
+
+// ValidateStages checks that every stage has a positive duration and that the
+// profile is either entirely rate driven or entirely concurrency driven.
+func ValidateStages(stages []Stage) error {
+	rate := StagesUseRate(stages)
+	peak := 0
+
+	for i, s := range stages {
+		if s.Duration <= 0 {
+			return errors.Errorf("stage %d: duration must be > 0", i)
+		}
+
+		if s.Concurrency < 0 || s.Rate < 0 {
+			return errors.Errorf("stage %d: concurrency and rate must be >= 0", i)
+		}
+
+		if rate && s.Concurrency > 0 {
+			return errors.Errorf("stage %d: stages must all use rate or all use concurrency", i)
+		}
+
+		if s.Concurrency > peak {
+			peak = s.Concurrency
+		}
+	}
+
+	if !rate && peak == 0 {
+		return errors.New("at least one stage must have a concurrency or rate > 0")
+	}
+
+	return nil
+}
+
+// StagesUseRate reports whether the profile is rate driven.
+func StagesUseRate(stages []Stage) bool {
+	for _, s := range stages {
+		if s.Rate > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StagesDuration is the total duration of the profile.
+func StagesDuration(stages []Stage) time.Duration {
+	var d time.Duration
+	for _, s := range stages {
+		d += s.Duration
+	}
+
+	return d
+}
+
+// StagesPeakConcurrency is the highest concurrency any stage reaches.
+func StagesPeakConcurrency(stages []Stage) int {
+	peak := 0
+	for _, s := range stages {
+		if s.Concurrency > peak {
+			peak = s.Concurrency
+		}
+	}
+
+	return peak
+}
+
+// stageAt returns the index of the stage active at elapsed, along with how far
+// into that stage elapsed is. Past the end of the profile it returns the last
+// stage.
+func stageAt(stages []Stage, elapsed time.Duration) (int, time.Duration) {
+	for i, s := range stages {
+		if elapsed < s.Duration {
+			return i, elapsed
+		}
+
+		elapsed -= s.Duration
+	}
+
+	last := len(stages) - 1
+
+	return last, stages[last].Duration
+}
+
+// stageLevel returns the load level at elapsed, where target picks either the
+// stage concurrency or rate. Ramp stages move linearly from the previous
+// stage's target to their own; other stages step straight to their target.
+func stageLevel(stages []Stage, elapsed time.Duration, target func(Stage) float64) float64 {
+	i, into := stageAt(stages, elapsed)
+	s := stages[i]
+
+	if !s.Ramp {
+		return target(s)
+	}
+
+	var from float64
+	if i > 0 {
+		from = target(stages[i-1])
+	}
+
+	progress := math.Min(float64(into)/float64(s.Duration), 1)
+
+	return from + (target(s)-from)*progress
+}
+
+func stageConcurrency(s Stage) float64 {
+	return float64(s.Concurrency)
+}
+
+func stageRate(s Stage) float64 {
+	return s.Rate
+}
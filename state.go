@@ -0,0 +1,169 @@
+package bench
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// State is a step in the lifecycle of a Job or a Task.
+type State string
+
+const (
+	// StatePending is a job or task that has been accepted but has no
+	// container yet.
+	StatePending State = "pending"
+	// StateProvisioning is a task whose container is starting, or a job with
+	// tasks that are not ready yet.
+	StateProvisioning State = "provisioning"
+	// StateReady is a task that is waiting for the rest of the job to be
+	// ready, or a job whose tasks are all ready.
+	StateReady State = "ready"
+	// StateRunning is a job or task that is sending requests.
+	StateRunning State = "running"
+	// StateReporting is a task that has sent interim results, or a job with
+	// some but not all of its final results in.
+	StateReporting State = "reporting"
+
+	StateCompleted State = "completed"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+	StateTimedOut  State = "timed-out"
+)
+
+// Failure policies decide what happens to a job when one of its tasks fails.
+const (
+	// FailureContinue lets the other tasks run without the failed one.
+	FailureContinue = "continue"
+	// FailureAbort fails the job and stops its other tasks.
+	FailureAbort = "abort"
+)
+
+// ErrInvalidTransition is returned when moving a job or task to a state that
+// cannot follow its current one.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// Terminal reports whether s is a final state.
+func (s State) Terminal() bool {
+	switch s {
+	case StateCompleted, StateFailed, StateCancelled, StateTimedOut:
+		return true
+	}
+
+	return false
+}
+
+// transitions lists the states that may follow each state. Any state that is
+// not terminal may also end in failure, cancellation or a timeout. Records
+// saved before states existed have no state and may only become pending.
+var transitions = map[State][]State{
+	"":                {StatePending},
+	StatePending:      {StateProvisioning},
+	StateProvisioning: {StateReady},
+	StateReady:        {StateRunning},
+	StateRunning:      {StateReporting, StateCompleted},
+	StateReporting:    {StateCompleted},
+}
+
+// CanTransition reports whether a job or task in state from may move to state
+// to. Staying in the same state is always allowed.
+func CanTransition(from, to State) bool {
+	if from == to {
+		return true
+	}
+
+	if from != "" && !from.Terminal() && to.Terminal() && to != StateCompleted {
+		return true
+	}
+
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Follows reports whether a job or task with the given state and history may
+// replace a copy saved in state saved: it must either have been through that
+// state or be able to move on from it. A stale copy that missed a change of
+// state does not follow the saved one.
+func Follows(saved, state State, history []Transition) bool {
+	if CanTransition(saved, state) {
+		return true
+	}
+
+	for _, t := range history {
+		if t.State == saved {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transition is a change of state and when it happened.
+type Transition struct {
+	State State     `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+func transition(state *State, history *[]Transition, to State, at time.Time) error {
+	if !CanTransition(*state, to) {
+		return errors.Wrapf(ErrInvalidTransition, "%q to %q", *state, to)
+	}
+
+	if *state == to {
+		return nil
+	}
+
+	*state = to
+	*history = append(*history, Transition{State: to, Time: at})
+
+	return nil
+}
+
+// Transition moves the job to state to, recording when it happened. The job
+// starts when it first runs and ends when it reaches a terminal state. It
+// returns ErrInvalidTransition, leaving the job unchanged, if to cannot follow
+// the current state.
+func (j *Job) Transition(to State, at time.Time) error {
+	err := transition(&j.State, &j.History, to, at)
+	if err != nil {
+		return errors.Wrap(err, "job")
+	}
+
+	if to == StateRunning && j.StartTime.IsZero() {
+		j.StartTime = at
+	}
+
+	if to.Terminal() && j.EndTime.IsZero() {
+		j.EndTime = at
+	}
+
+	return nil
+}
+
+// Transition moves the task to state to, recording when it happened. It
+// returns ErrInvalidTransition, leaving the task unchanged, if to cannot
+// follow the current state.
+func (t *Task) Transition(to State, at time.Time) error {
+	err := transition(&t.State, &t.History, to, at)
+	if err != nil {
+		return errors.Wrap(err, "task")
+	}
+
+	t.Ready = t.Ready || to == StateReady
+
+	return nil
+}
+
+// Since returns when the task entered its current state.
+func (t *Task) Since() time.Time {
+	if len(t.History) == 0 {
+		return time.Time{}
+	}
+
+	return t.History[len(t.History)-1].Time
+}
@@ -0,0 +1,93 @@
+package bench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestJobTransition(t *testing.T) {
+	var j bench.Job
+
+	at := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, s := range []bench.State{bench.StatePending, bench.StateProvisioning, bench.StateReady, bench.StateRunning, bench.StateReporting, bench.StateCompleted} {
+		if err := j.Transition(s, at.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	if len(j.History) != 6 {
+		t.Errorf("expected 6 transitions, got %d", len(j.History))
+	}
+
+	if !j.StartTime.Equal(at.Add(3 * time.Second)) {
+		t.Errorf("expected the job to start when it ran, got %s", j.StartTime)
+	}
+
+	if !j.EndTime.Equal(at.Add(5 * time.Second)) {
+		t.Errorf("expected the job to end when it completed, got %s", j.EndTime)
+	}
+
+	err := j.Transition(bench.StateRunning, at)
+	if errors.Cause(err) != bench.ErrInvalidTransition {
+		t.Errorf("expected a completed job not to run again, got %v", err)
+	}
+
+	if j.State != bench.StateCompleted || len(j.History) != 6 {
+		t.Errorf("expected a rejected transition to leave the job unchanged, got %s", j.State)
+	}
+}
+
+func TestTaskTransition(t *testing.T) {
+	var task bench.Task
+
+	if err := task.Transition(bench.StateRunning, time.Now()); errors.Cause(err) != bench.ErrInvalidTransition {
+		t.Errorf("expected a new task not to run, got %v", err)
+	}
+
+	for _, s := range []bench.State{bench.StatePending, bench.StateProvisioning, bench.StateReady, bench.StateReady} {
+		if err := task.Transition(s, time.Now()); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	if !task.Ready || len(task.History) != 3 {
+		t.Errorf("expected a ready task with 3 transitions, got %+v", task)
+	}
+
+	if err := task.Transition(bench.StateCompleted, time.Now()); errors.Cause(err) != bench.ErrInvalidTransition {
+		t.Errorf("expected a task that never ran not to complete, got %v", err)
+	}
+
+	if err := task.Transition(bench.StateTimedOut, time.Now()); err != nil {
+		t.Errorf("expected a ready task to time out, got %s", err)
+	}
+}
+
+func TestFollows(t *testing.T) {
+	var stale, current bench.Task
+
+	stale.Transition(bench.StatePending, time.Now())
+	stale.Transition(bench.StateProvisioning, time.Now())
+
+	current = stale
+	current.History = append([]bench.Transition(nil), stale.History...)
+	current.Transition(bench.StateReady, time.Now())
+	current.Transition(bench.StateRunning, time.Now())
+
+	if !bench.Follows(bench.StateProvisioning, current.State, current.History) {
+		t.Errorf("expected a task that went through the saved state to follow it")
+	}
+
+	if bench.Follows(current.State, stale.State, stale.History) {
+		t.Errorf("expected a stale task not to follow the saved one")
+	}
+
+	if !bench.Follows(bench.StateRunning, bench.StateCancelled, nil) {
+		t.Errorf("expected a running task to be cancellable")
+	}
+}
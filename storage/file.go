@@ -0,0 +1,521 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// File stores jobs as JSON files in a directory, for installs with a single
+// benchapi. Each job has a directory holding job.json, a tasks directory with
+// a file per task and a data directory with the uploaded data files. Files are
+// written to a temporary file and renamed, so a crash never leaves one half
+// written.
+type File struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFile returns a store that keeps its files in dir, creating it if needed.
+func NewFile(dir string) (*File, error) {
+	err := os.MkdirAll(filepath.Join(dir, "jobs"), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating data directory")
+	}
+
+	return &File{
+		dir: dir,
+	}, nil
+}
+
+func (f *File) jobDir(runID string) string {
+	return filepath.Join(f.dir, "jobs", filepath.Base(runID))
+}
+
+func (f *File) jobPath(runID string) string {
+	return filepath.Join(f.jobDir(runID), "job.json")
+}
+
+func (f *File) taskPath(runID, taskID string) string {
+	return filepath.Join(f.jobDir(runID), "tasks", filepath.Base(taskID)+".json")
+}
+
+func (f *File) dataPath(runID, name string) string {
+	return filepath.Join(f.jobDir(runID), "data", filepath.Base(name))
+}
+
+// SaveJob saves the job and its tasks. It fails with ErrVersionConflict if any
+// of them was saved by someone else since it was read, and with
+// bench.ErrInvalidTransition if one does not follow the saved one, saving
+// none of them. Once saved, their versions are bumped.
+func (f *File) SaveJob(j *bench.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.checkJob(j)
+	if err != nil {
+		return err
+	}
+
+	for i := range j.Tasks {
+		err = f.checkTask(j.RunID, &j.Tasks[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.writeJob(j)
+	if err != nil {
+		return err
+	}
+
+	for i := range j.Tasks {
+		err = f.writeTask(j.RunID, &j.Tasks[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddTask saves a task and adds it to the tasks of its job.
+func (f *File) AddTask(runID string, t *bench.Task) error {
+	return f.SaveTask(runID, t)
+}
+
+// UpdateJob saves the job without its tasks, which are saved on their own by
+// SaveTask. It fails like SaveJob.
+func (f *File) UpdateJob(j *bench.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.checkJob(j)
+	if err != nil {
+		return err
+	}
+
+	return f.writeJob(j)
+}
+
+func (f *File) checkJob(j *bench.Job) error {
+	current, err := readSaved(f.jobPath(j.RunID))
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(current.check(j.Version, j.State, j.History), "job")
+}
+
+func (f *File) writeJob(j *bench.Job) error {
+	next := *j
+	next.Version++
+	next.Tasks = nil
+
+	err := writeJSON(f.jobPath(j.RunID), &next)
+	if err != nil {
+		return err
+	}
+
+	j.Version++
+
+	return nil
+}
+
+// ActiveJobs returns the run IDs of the jobs that have not reached a terminal
+// state.
+func (f *File) ActiveJobs() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dirs, err := ioutil.ReadDir(filepath.Join(f.dir, "jobs"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting active jobs")
+	}
+
+	runIDs := []string{}
+
+	for _, dir := range dirs {
+		var j bench.Job
+
+		err = readJSON(f.jobPath(dir.Name()), &j)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting active jobs")
+		}
+
+		if !j.State.Terminal() {
+			runIDs = append(runIDs, j.RunID)
+		}
+	}
+
+	return runIDs, nil
+}
+
+// ListJobs returns the page of jobs matching q, newest first, without their
+// tasks. Every job is read, so it is only suited to a modest history.
+func (f *File) ListJobs(q JobQuery) (JobList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dirs, err := ioutil.ReadDir(filepath.Join(f.dir, "jobs"))
+	if err != nil {
+		return JobList{}, errors.Wrap(err, "error listing jobs")
+	}
+
+	var jobs []bench.Job
+
+	for _, dir := range dirs {
+		var j bench.Job
+
+		err = readJSON(f.jobPath(dir.Name()), &j)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+
+		if err != nil {
+			return JobList{}, errors.Wrap(err, "error listing jobs")
+		}
+
+		if q.Match(j) {
+			jobs = append(jobs, j)
+		}
+	}
+
+	return q.page(jobs), nil
+}
+
+func (f *File) GetJob(runID string) (bench.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var j bench.Job
+
+	err := readJSON(f.jobPath(runID), &j)
+	if err != nil {
+		return j, errors.Wrap(err, "error getting job data")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(f.jobDir(runID), "tasks"))
+	if err != nil && !os.IsNotExist(err) {
+		return j, errors.Wrap(err, "error getting tasks data")
+	}
+
+	j.Tasks = []bench.Task{}
+
+	for _, file := range files {
+		// Skip temporary files left by a crash while writing.
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		var t bench.Task
+
+		err = readJSON(filepath.Join(f.jobDir(runID), "tasks", file.Name()), &t)
+		if err != nil {
+			return j, errors.Wrap(err, "error getting task")
+		}
+
+		j.Tasks = append(j.Tasks, t)
+	}
+
+	return j, nil
+}
+
+func (f *File) GetTask(runID, taskID string) (bench.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var t bench.Task
+
+	err := readJSON(f.taskPath(runID, taskID), &t)
+	if err != nil {
+		return t, errors.Wrap(err, "error getting task data")
+	}
+
+	return t, nil
+}
+
+// SaveTask saves the task. It fails like SaveJob.
+func (f *File) SaveTask(runID string, t *bench.Task) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.checkTask(runID, t)
+	if err != nil {
+		return err
+	}
+
+	return f.writeTask(runID, t)
+}
+
+// ModifyTask applies fn to the saved task and saves it, starting again if the
+// task is saved by someone else in the meantime. It returns the saved task.
+func (f *File) ModifyTask(runID, taskID string, fn func(t *bench.Task) error) (bench.Task, error) {
+	return modifyTask(f, runID, taskID, fn)
+}
+
+func (f *File) checkTask(runID string, t *bench.Task) error {
+	current, err := readSaved(f.taskPath(runID, t.ID))
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrapf(current.check(t.Version, t.State, t.History), "task %s", t.ID)
+}
+
+func (f *File) writeTask(runID string, t *bench.Task) error {
+	next := *t
+	next.Version++
+
+	err := writeJSON(f.taskPath(runID, t.ID), &next)
+	if err != nil {
+		return err
+	}
+
+	t.Version++
+
+	return nil
+}
+
+// readSaved returns the state and version saved at path, or nil if nothing
+// is.
+func readSaved(path string) (*saved, error) {
+	var current saved
+
+	err := readJSON(path, &current)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting current state")
+	}
+
+	return &current, nil
+}
+
+func (f *File) SaveData(runID, name string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := writeFile(f.dataPath(runID, name), data)
+	if err != nil {
+		return errors.Wrap(err, "error saving data")
+	}
+
+	return nil
+}
+
+func (f *File) GetData(runID, name string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := ioutil.ReadFile(f.dataPath(runID, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data")
+	}
+
+	return data, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return errors.Wrapf(err, "error unmarshalling %s", path)
+	}
+
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling")
+	}
+
+	return writeFile(path, data)
+}
+
+// writeFile replaces the file at path with data by writing it to a temporary
+// file in the same directory and renaming that over it.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "error creating directory")
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return errors.Wrap(err, "error creating file")
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "error writing %s", path)
+	}
+
+	return nil
+}
+
+// retirement records when the records of a retired job expire.
+type retirement struct {
+	RawExpires time.Time `json:"rawExpires"`
+	Expires    time.Time `json:"expires"`
+}
+
+func (f *File) summaryPath(runID string) string {
+	return filepath.Join(f.jobDir(runID), "summary.json")
+}
+
+func (f *File) retirementPath(runID string) string {
+	return filepath.Join(f.jobDir(runID), "retirement.json")
+}
+
+// EndedJobs returns the run IDs of the jobs that ended before before and have
+// not been retired.
+func (f *File) EndedJobs(before time.Time) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dirs, err := ioutil.ReadDir(filepath.Join(f.dir, "jobs"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting ended jobs")
+	}
+
+	runIDs := []string{}
+
+	for _, dir := range dirs {
+		var j bench.Job
+
+		err = readJSON(f.jobPath(dir.Name()), &j)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting ended jobs")
+		}
+
+		if !j.State.Terminal() || !j.EndTime.Before(before) {
+			continue
+		}
+
+		_, err = os.Stat(f.retirementPath(j.RunID))
+		if os.IsNotExist(err) {
+			runIDs = append(runIDs, j.RunID)
+		} else if err != nil {
+			return nil, errors.Wrap(err, "error getting ended jobs")
+		}
+	}
+
+	return runIDs, nil
+}
+
+// RetireJob saves the compacted result of a job that ended and sets when its
+// records expire as set by retention. Purge removes them once they have.
+func (f *File) RetireJob(runID string, summary []byte, retention Retention) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := writeFile(f.summaryPath(runID), summary)
+	if err != nil {
+		return errors.Wrap(err, "error saving summary")
+	}
+
+	now := time.Now()
+
+	err = writeJSON(f.retirementPath(runID), retirement{
+		RawExpires: expires(now, retention.raw()),
+		Expires:    expires(now, retention.Summary),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error retiring job")
+	}
+
+	return nil
+}
+
+// GetSummary returns the compacted result of a retired job.
+func (f *File) GetSummary(runID string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := ioutil.ReadFile(f.summaryPath(runID))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting summary")
+	}
+
+	return data, nil
+}
+
+// Purge removes the records of retired jobs that expired by now.
+func (f *File) Purge(now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dirs, err := ioutil.ReadDir(filepath.Join(f.dir, "jobs"))
+	if err != nil {
+		return errors.Wrap(err, "error purging jobs")
+	}
+
+	for _, dir := range dirs {
+		var r retirement
+
+		err = readJSON(f.retirementPath(dir.Name()), &r)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error purging jobs")
+		}
+
+		switch {
+		case !r.Expires.IsZero() && !now.Before(r.Expires):
+			err = os.RemoveAll(f.jobDir(dir.Name()))
+		case !r.RawExpires.IsZero() && !now.Before(r.RawExpires):
+			err = os.RemoveAll(filepath.Join(f.jobDir(dir.Name()), "tasks"))
+			if err == nil {
+				err = os.RemoveAll(filepath.Join(f.jobDir(dir.Name()), "data"))
+			}
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "error purging job %s", dir.Name())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package storage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rickbassham/bench/storage"
+	"github.com/rickbassham/bench/storage/storagetest"
+)
+
+func TestFile(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (storagetest.Store, func()) {
+		dir, err := ioutil.TempDir("", "bench")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := storage.NewFile(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%+v", err)
+		}
+
+		return f, func() { os.RemoveAll(dir) }
+	})
+}
@@ -0,0 +1,610 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// migrations are the changes to the schema, in order. Each is applied once, in
+// a transaction, and recorded in schema_migrations. Only ever append to it.
+var migrations = []string{
+	`CREATE TABLE jobs (
+		run_id text PRIMARY KEY,
+		state text NOT NULL,
+		request_time timestamptz NOT NULL,
+		data jsonb NOT NULL
+	);
+	CREATE INDEX jobs_state ON jobs (state);
+	CREATE INDEX jobs_request_time ON jobs (request_time);
+
+	CREATE TABLE tasks (
+		run_id text NOT NULL REFERENCES jobs ON DELETE CASCADE,
+		task_id text NOT NULL,
+		seq bigserial NOT NULL,
+		state text NOT NULL,
+		data jsonb NOT NULL,
+		PRIMARY KEY (run_id, task_id)
+	);
+
+	CREATE TABLE job_data (
+		run_id text NOT NULL,
+		name text NOT NULL,
+		data bytea NOT NULL,
+		PRIMARY KEY (run_id, name)
+	);`,
+	`CREATE INDEX jobs_url ON jobs ((data->>'url'));
+	CREATE INDEX jobs_meta ON jobs USING gin ((data->'meta') jsonb_path_ops);`,
+	`ALTER TABLE jobs ADD COLUMN version bigint NOT NULL DEFAULT 0;
+	ALTER TABLE tasks ADD COLUMN version bigint NOT NULL DEFAULT 0;`,
+	`ALTER TABLE jobs ADD COLUMN end_time timestamptz;
+	ALTER TABLE jobs ADD COLUMN retired boolean NOT NULL DEFAULT false;
+	ALTER TABLE jobs ADD COLUMN raw_expires timestamptz;
+	ALTER TABLE jobs ADD COLUMN expires timestamptz;
+	UPDATE jobs SET end_time = (data->>'endTime')::timestamptz
+		WHERE state IN ('completed', 'failed', 'cancelled', 'timed-out');
+	CREATE INDEX jobs_ended ON jobs (end_time) WHERE NOT retired;
+	CREATE INDEX jobs_expires ON jobs (expires);
+
+	CREATE TABLE job_summaries (
+		run_id text PRIMARY KEY REFERENCES jobs ON DELETE CASCADE,
+		data bytea NOT NULL
+	);`,
+}
+
+// migrationLock is the advisory lock held while migrating, so several
+// benchapi instances starting at once do not apply the same migration.
+const migrationLock = 4242170
+
+// Postgres stores jobs in PostgreSQL, keeping them queryable for as long as
+// they are needed. Jobs and tasks are kept as JSON alongside the columns they
+// are looked up by.
+type Postgres struct {
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db: db,
+	}
+}
+
+// Migrate brings the schema up to date.
+func (p *Postgres) Migrate() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		applied timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "error creating schema_migrations")
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "error starting migration")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock)
+	if err != nil {
+		return errors.Wrap(err, "error locking schema_migrations")
+	}
+
+	var version int
+
+	err = tx.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return errors.Wrap(err, "error getting schema version")
+	}
+
+	for i := version; i < len(migrations); i++ {
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			return errors.Wrapf(err, "error applying migration %d", i+1)
+		}
+
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1)
+		if err != nil {
+			return errors.Wrapf(err, "error recording migration %d", i+1)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing migrations")
+	}
+
+	return nil
+}
+
+// SaveJob saves the job and its tasks in one transaction. It fails with
+// ErrVersionConflict if any of them was saved by someone else since it was
+// read, and with bench.ErrInvalidTransition if one does not follow the saved
+// one. Once saved, their versions are bumped.
+func (p *Postgres) SaveJob(j *bench.Job) error {
+	err := p.inTx(func(tx *sql.Tx) error {
+		err := updateJob(tx, *j)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range j.Tasks {
+			err = saveTask(tx, j.RunID, t)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	j.Version++
+
+	for i := range j.Tasks {
+		j.Tasks[i].Version++
+	}
+
+	return nil
+}
+
+// AddTask saves a task and adds it to the tasks of its job.
+func (p *Postgres) AddTask(runID string, t *bench.Task) error {
+	return p.SaveTask(runID, t)
+}
+
+// UpdateJob saves the job without its tasks, which are saved on their own by
+// SaveTask. It fails like SaveJob.
+func (p *Postgres) UpdateJob(j *bench.Job) error {
+	err := p.inTx(func(tx *sql.Tx) error {
+		return updateJob(tx, *j)
+	})
+	if err != nil {
+		return err
+	}
+
+	j.Version++
+
+	return nil
+}
+
+func updateJob(tx *sql.Tx, j bench.Job) error {
+	row := tx.QueryRow(`SELECT state, version FROM jobs WHERE run_id = $1 FOR UPDATE`, j.RunID)
+
+	current, err := scanSaved(row)
+	if err != nil {
+		return err
+	}
+
+	err = current.check(j.Version, j.State, j.History)
+	if err != nil {
+		return errors.Wrap(err, "job")
+	}
+
+	j.Version++
+	j.Tasks = nil
+
+	jobData, err := json.Marshal(&j)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling job")
+	}
+
+	// end_time is only set once the job has ended, so EndedJobs can find it.
+	var endTime *time.Time
+	if j.State.Terminal() {
+		endTime = &j.EndTime
+	}
+
+	if current == nil {
+		return insert(tx, `INSERT INTO jobs (run_id, state, request_time, version, data, end_time) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING`, j.RunID, string(j.State), j.RequestTime, j.Version, string(jobData), endTime)
+	}
+
+	_, err = tx.Exec(`UPDATE jobs SET state = $2, request_time = $3, version = $4, data = $5, end_time = $6 WHERE run_id = $1`,
+		j.RunID, string(j.State), j.RequestTime, j.Version, string(jobData), endTime)
+	if err != nil {
+		return errors.Wrap(err, "error saving job data")
+	}
+
+	return nil
+}
+
+// ActiveJobs returns the run IDs of the jobs that have not reached a terminal
+// state.
+func (p *Postgres) ActiveJobs() ([]string, error) {
+	rows, err := p.db.Query(`SELECT run_id FROM jobs WHERE state NOT IN ($1, $2, $3, $4) ORDER BY request_time`,
+		string(bench.StateCompleted), string(bench.StateFailed), string(bench.StateCancelled), string(bench.StateTimedOut))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting active jobs")
+	}
+	defer rows.Close()
+
+	runIDs := []string{}
+
+	for rows.Next() {
+		var runID string
+
+		err = rows.Scan(&runID)
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting active jobs")
+		}
+
+		runIDs = append(runIDs, runID)
+	}
+
+	return runIDs, errors.Wrap(rows.Err(), "error getting active jobs")
+}
+
+// ListJobs returns the page of jobs matching q, newest first, without their
+// tasks.
+func (p *Postgres) ListJobs(q JobQuery) (JobList, error) {
+	var where []string
+	var args []interface{}
+
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.URL != "" {
+		where = append(where, "data->>'url' = "+arg(q.URL))
+	}
+
+	if q.State != "" {
+		where = append(where, "state = "+arg(string(q.State)))
+	}
+
+	if !q.From.IsZero() {
+		where = append(where, "request_time >= "+arg(q.From))
+	}
+
+	if !q.To.IsZero() {
+		where = append(where, "request_time < "+arg(q.To))
+	}
+
+	if len(q.Meta) > 0 {
+		meta, err := json.Marshal(q.Meta)
+		if err != nil {
+			return JobList{}, errors.Wrap(err, "error marshalling meta")
+		}
+
+		where = append(where, "data->'meta' @> "+arg(string(meta))+"::jsonb")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	list := JobList{
+		Jobs: []bench.Job{},
+	}
+
+	err := p.db.QueryRow(`SELECT count(*) FROM jobs`+filter, args...).Scan(&list.Total)
+	if err != nil {
+		return list, errors.Wrap(err, "error counting jobs")
+	}
+
+	limit := "ALL"
+	if q.Limit > 0 {
+		limit = arg(q.Limit)
+	}
+
+	rows, err := p.db.Query(`SELECT data FROM jobs`+filter+
+		` ORDER BY request_time DESC, run_id DESC LIMIT `+limit+` OFFSET `+arg(q.Offset), args...)
+	if err != nil {
+		return list, errors.Wrap(err, "error listing jobs")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j bench.Job
+		var jobData []byte
+
+		err = rows.Scan(&jobData)
+		if err != nil {
+			return list, errors.Wrap(err, "error listing jobs")
+		}
+
+		err = json.Unmarshal(jobData, &j)
+		if err != nil {
+			return list, errors.Wrap(err, "error unmarshalling job")
+		}
+
+		list.Jobs = append(list.Jobs, j)
+	}
+
+	return list, errors.Wrap(rows.Err(), "error listing jobs")
+}
+
+func (p *Postgres) GetJob(runID string) (bench.Job, error) {
+	var j bench.Job
+	var jobData []byte
+
+	err := p.db.QueryRow(`SELECT data FROM jobs WHERE run_id = $1`, runID).Scan(&jobData)
+	if err != nil {
+		return j, errors.Wrap(err, "error getting job data")
+	}
+
+	err = json.Unmarshal(jobData, &j)
+	if err != nil {
+		return j, errors.Wrap(err, "error unmarshalling job")
+	}
+
+	rows, err := p.db.Query(`SELECT data FROM tasks WHERE run_id = $1 ORDER BY seq`, runID)
+	if err != nil {
+		return j, errors.Wrap(err, "error getting tasks data")
+	}
+	defer rows.Close()
+
+	j.Tasks = []bench.Task{}
+
+	for rows.Next() {
+		var t bench.Task
+		var taskData []byte
+
+		err = rows.Scan(&taskData)
+		if err != nil {
+			return j, errors.Wrap(err, "error getting task")
+		}
+
+		err = json.Unmarshal(taskData, &t)
+		if err != nil {
+			return j, errors.Wrap(err, "error unmarshalling task")
+		}
+
+		j.Tasks = append(j.Tasks, t)
+	}
+
+	return j, errors.Wrap(rows.Err(), "error getting tasks data")
+}
+
+func (p *Postgres) GetTask(runID, taskID string) (bench.Task, error) {
+	var t bench.Task
+	var taskData []byte
+
+	err := p.db.QueryRow(`SELECT data FROM tasks WHERE run_id = $1 AND task_id = $2`, runID, taskID).Scan(&taskData)
+	if err != nil {
+		return t, errors.Wrap(err, "error getting task data")
+	}
+
+	err = json.Unmarshal(taskData, &t)
+	if err != nil {
+		return t, errors.Wrap(err, "error unmarshalling task")
+	}
+
+	return t, nil
+}
+
+// SaveTask saves the task. It fails like SaveJob.
+func (p *Postgres) SaveTask(runID string, t *bench.Task) error {
+	err := p.inTx(func(tx *sql.Tx) error {
+		return saveTask(tx, runID, *t)
+	})
+	if err != nil {
+		return err
+	}
+
+	t.Version++
+
+	return nil
+}
+
+// ModifyTask applies f to the saved task and saves it, starting again if the
+// task is saved by someone else in the meantime. It returns the saved task.
+func (p *Postgres) ModifyTask(runID, taskID string, f func(t *bench.Task) error) (bench.Task, error) {
+	return modifyTask(p, runID, taskID, f)
+}
+
+func saveTask(tx *sql.Tx, runID string, t bench.Task) error {
+	row := tx.QueryRow(`SELECT state, version FROM tasks WHERE run_id = $1 AND task_id = $2 FOR UPDATE`, runID, t.ID)
+
+	current, err := scanSaved(row)
+	if err != nil {
+		return err
+	}
+
+	err = current.check(t.Version, t.State, t.History)
+	if err != nil {
+		return errors.Wrapf(err, "task %s", t.ID)
+	}
+
+	t.Version++
+
+	taskData, err := json.Marshal(&t)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling task")
+	}
+
+	if current == nil {
+		return insert(tx, `INSERT INTO tasks (run_id, task_id, state, version, data) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, runID, t.ID, string(t.State), t.Version, string(taskData))
+	}
+
+	_, err = tx.Exec(`UPDATE tasks SET state = $3, version = $4, data = $5 WHERE run_id = $1 AND task_id = $2`,
+		runID, t.ID, string(t.State), t.Version, string(taskData))
+	if err != nil {
+		return errors.Wrap(err, "error saving task data")
+	}
+
+	return nil
+}
+
+// scanSaved returns the state and version in row, the locked saved ones, or
+// nil if nothing is saved.
+func scanSaved(row *sql.Row) (*saved, error) {
+	var current saved
+	var state string
+
+	err := row.Scan(&state, &current.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting current state")
+	}
+
+	current.State = bench.State(state)
+
+	return &current, nil
+}
+
+// insert runs an insert that does nothing if the row exists, which means it
+// was saved by someone else since it was found missing.
+func insert(tx *sql.Tx, query string, args ...interface{}) error {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return errors.Wrap(err, "error inserting")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "error inserting")
+	}
+
+	if n == 0 {
+		return errors.Wrap(ErrVersionConflict, "saved by someone else while saving")
+	}
+
+	return nil
+}
+
+func (p *Postgres) SaveData(runID, name string, data []byte) error {
+	_, err := p.db.Exec(`INSERT INTO job_data (run_id, name, data) VALUES ($1, $2, $3)
+		ON CONFLICT (run_id, name) DO UPDATE SET data = EXCLUDED.data`, runID, name, data)
+	if err != nil {
+		return errors.Wrap(err, "error saving data")
+	}
+
+	return nil
+}
+
+func (p *Postgres) GetData(runID, name string) ([]byte, error) {
+	var data []byte
+
+	err := p.db.QueryRow(`SELECT data FROM job_data WHERE run_id = $1 AND name = $2`, runID, name).Scan(&data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data")
+	}
+
+	return data, nil
+}
+
+// EndedJobs returns the run IDs of the jobs that ended before before and have
+// not been retired.
+func (p *Postgres) EndedJobs(before time.Time) ([]string, error) {
+	rows, err := p.db.Query(`SELECT run_id FROM jobs WHERE NOT retired AND end_time < $1 ORDER BY end_time`, before)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting ended jobs")
+	}
+	defer rows.Close()
+
+	runIDs := []string{}
+
+	for rows.Next() {
+		var runID string
+
+		err = rows.Scan(&runID)
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting ended jobs")
+		}
+
+		runIDs = append(runIDs, runID)
+	}
+
+	return runIDs, errors.Wrap(rows.Err(), "error getting ended jobs")
+}
+
+// RetireJob saves the compacted result of a job that ended and sets when its
+// records expire as set by retention. Purge deletes them once they have.
+func (p *Postgres) RetireJob(runID string, summary []byte, retention Retention) error {
+	now := time.Now()
+
+	var rawExpires, expiresAt *time.Time
+	if t := expires(now, retention.raw()); !t.IsZero() {
+		rawExpires = &t
+	}
+	if t := expires(now, retention.Summary); !t.IsZero() {
+		expiresAt = &t
+	}
+
+	return p.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO job_summaries (run_id, data) VALUES ($1, $2)
+			ON CONFLICT (run_id) DO UPDATE SET data = EXCLUDED.data`, runID, summary)
+		if err != nil {
+			return errors.Wrap(err, "error saving summary")
+		}
+
+		_, err = tx.Exec(`UPDATE jobs SET retired = true, raw_expires = $2, expires = $3 WHERE run_id = $1`,
+			runID, rawExpires, expiresAt)
+		if err != nil {
+			return errors.Wrap(err, "error retiring job")
+		}
+
+		return nil
+	})
+}
+
+// GetSummary returns the compacted result of a retired job.
+func (p *Postgres) GetSummary(runID string) ([]byte, error) {
+	var data []byte
+
+	err := p.db.QueryRow(`SELECT data FROM job_summaries WHERE run_id = $1`, runID).Scan(&data)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting summary")
+	}
+
+	return data, nil
+}
+
+// Purge deletes the records of retired jobs that expired by now.
+func (p *Postgres) Purge(now time.Time) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM tasks WHERE run_id IN (SELECT run_id FROM jobs WHERE raw_expires <= $1)`, now)
+		if err != nil {
+			return errors.Wrap(err, "error purging tasks")
+		}
+
+		_, err = tx.Exec(`DELETE FROM job_data WHERE run_id IN (SELECT run_id FROM jobs WHERE raw_expires <= $1)`, now)
+		if err != nil {
+			return errors.Wrap(err, "error purging data")
+		}
+
+		_, err = tx.Exec(`DELETE FROM jobs WHERE expires <= $1`, now)
+		if err != nil {
+			return errors.Wrap(err, "error purging jobs")
+		}
+
+		return nil
+	})
+}
+
+// inTx runs f in a transaction, committing it if f succeeds.
+func (p *Postgres) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package storage_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"github.com/rickbassham/bench/storage"
+	"github.com/rickbassham/bench/storage/storagetest"
+)
+
+// TestPostgres needs a database it may empty, set in BENCH_TEST_POSTGRES_URL.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("BENCH_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("BENCH_TEST_POSTGRES_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	p := storage.NewPostgres(db)
+
+	err = p.Migrate()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Migrating again must be a no-op.
+	err = p.Migrate()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	storagetest.Run(t, func(t *testing.T) (storagetest.Store, func()) {
+		_, err := db.Exec(`TRUNCATE jobs, tasks, job_data`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return p, func() {}
+	})
+}
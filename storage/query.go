@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+// JobQuery selects jobs for ListJobs. Empty fields match every job.
+type JobQuery struct {
+	URL   string
+	State bench.State
+	// From and To limit the RequestTime of the jobs to [From, To).
+	From time.Time
+	To   time.Time
+	// Meta matches jobs with all of these MetaData values.
+	Meta map[string]string
+
+	Offset int
+	Limit  int
+}
+
+// Match reports whether j is selected by the query.
+func (q JobQuery) Match(j bench.Job) bool {
+	if q.URL != "" && j.URL != q.URL {
+		return false
+	}
+
+	if q.State != "" && j.State != q.State {
+		return false
+	}
+
+	if !q.From.IsZero() && j.RequestTime.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && !j.RequestTime.Before(q.To) {
+		return false
+	}
+
+	for k, v := range q.Meta {
+		if actual, ok := j.MetaData[k]; !ok || actual != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// JobList is a page of the jobs matching a JobQuery, newest first. Total
+// counts every matching job, not only those on the page.
+type JobList struct {
+	Jobs  []bench.Job `json:"jobs"`
+	Total int         `json:"total"`
+}
+
+// page sorts jobs newest first and returns the page of them the query asks
+// for.
+func (q JobQuery) page(jobs []bench.Job) JobList {
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].RequestTime.Equal(jobs[j].RequestTime) {
+			return jobs[i].RunID > jobs[j].RunID
+		}
+
+		return jobs[i].RequestTime.After(jobs[j].RequestTime)
+	})
+
+	list := JobList{
+		Jobs:  []bench.Job{},
+		Total: len(jobs),
+	}
+
+	if q.Offset >= len(jobs) {
+		return list
+	}
+
+	jobs = jobs[q.Offset:]
+
+	if q.Limit > 0 && q.Limit < len(jobs) {
+		jobs = jobs[:q.Limit]
+	}
+
+	list.Jobs = jobs
+
+	return list
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	"github.com/rickbassham/bench"
@@ -14,9 +17,15 @@ import (
 
 type Client interface {
 	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	SAdd(key string, members ...interface{}) *redis.IntCmd
 	Get(key string) *redis.StringCmd
 	SMembers(key string) *redis.StringSliceCmd
+	Del(keys ...string) *redis.IntCmd
+	ZInterStore(destination string, store redis.ZStore, keys ...string) *redis.IntCmd
+	ZCount(key, min, max string) *redis.IntCmd
+	ZRevRangeByScore(key string, opt redis.ZRangeBy) *redis.StringSliceCmd
+	Watch(fn func(*redis.Tx) error, keys ...string) error
+	TxPipelined(fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+	ZRangeByScore(key string, opt redis.ZRangeBy) *redis.StringSliceCmd
 }
 
 type Redis struct {
@@ -29,30 +38,322 @@ func NewRedis(r Client) *Redis {
 	}
 }
 
-func (r *Redis) SaveJob(j bench.Job) error {
-	jobData, err := json.Marshal(&j)
+func jobKey(runID string) string {
+	return fmt.Sprintf("JOB_%s", runID)
+}
+
+func taskKey(runID, taskID string) string {
+	return fmt.Sprintf("JOB_%s_TASK_%s", runID, taskID)
+}
+
+func tasksKey(runID string) string {
+	return fmt.Sprintf("JOB_%s_TASKS", runID)
+}
+
+// SaveJob saves the job and its tasks in one transaction. It fails with
+// ErrVersionConflict if any of them was saved by someone else since it was
+// read, and with bench.ErrInvalidTransition if one does not follow the saved
+// one. Once saved, their versions are bumped.
+func (r *Redis) SaveJob(j *bench.Job) error {
+	tasks := make([]*bench.Task, len(j.Tasks))
+	for i := range j.Tasks {
+		tasks[i] = &j.Tasks[i]
+	}
+
+	return r.save(j.RunID, j, tasks...)
+}
+
+// AddTask saves a task and adds it to the tasks of its job.
+func (r *Redis) AddTask(runID string, t *bench.Task) error {
+	return r.save(runID, nil, t)
+}
+
+// UpdateJob saves the job without its tasks, which are saved on their own by
+// SaveTask. It fails like SaveJob.
+func (r *Redis) UpdateJob(j *bench.Job) error {
+	return r.save(j.RunID, j)
+}
+
+// save saves the job, if any, and tasks in a transaction that only goes
+// through if none of them was saved by someone else while checking them.
+func (r *Redis) save(runID string, j *bench.Job, tasks ...*bench.Task) error {
+	var keys []string
+
+	if j != nil {
+		keys = append(keys, jobKey(runID))
+	}
+
+	for _, t := range tasks {
+		keys = append(keys, taskKey(runID, t.ID))
+	}
+
+	err := r.r.Watch(func(tx *redis.Tx) error {
+		var previous bench.State
+		var jobData []byte
+
+		if j != nil {
+			current, err := getSaved(tx, jobKey(runID))
+			if err != nil {
+				return err
+			}
+
+			err = current.check(j.Version, j.State, j.History)
+			if err != nil {
+				return errors.Wrap(err, "job")
+			}
+
+			if current != nil {
+				previous = current.State
+			}
+
+			next := *j
+			next.Version++
+			next.Tasks = nil
+
+			jobData, err = json.Marshal(&next)
+			if err != nil {
+				return errors.Wrap(err, "error marshalling job")
+			}
+		}
+
+		taskData := make([][]byte, len(tasks))
+
+		for i, t := range tasks {
+			current, err := getSaved(tx, taskKey(runID, t.ID))
+			if err != nil {
+				return err
+			}
+
+			err = current.check(t.Version, t.State, t.History)
+			if err != nil {
+				return errors.Wrapf(err, "task %s", t.ID)
+			}
+
+			next := *t
+			next.Version++
+
+			taskData[i], err = json.Marshal(&next)
+			if err != nil {
+				return errors.Wrap(err, "error marshalling task")
+			}
+		}
+
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			if j != nil {
+				pipe.Set(jobKey(runID), jobData, 0)
+
+				if j.State.Terminal() {
+					pipe.SRem(activeJobsKey, runID)
+				} else {
+					pipe.SAdd(activeJobsKey, runID)
+				}
+
+				index(pipe, *j, previous)
+
+				if j.State.Terminal() && !previous.Terminal() {
+					pipe.ZAdd(endedJobsKey, redis.Z{Score: score(j.EndTime), Member: runID})
+				}
+			}
+
+			for i, t := range tasks {
+				pipe.Set(taskKey(runID, t.ID), taskData[i], 0)
+				pipe.SAdd(tasksKey(runID), t.ID)
+			}
+
+			return nil
+		})
+
+		return err
+	}, keys...)
+
+	if err == redis.TxFailedErr {
+		return errors.Wrap(ErrVersionConflict, "saved by someone else while saving")
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "error saving")
+	}
+
+	if j != nil {
+		j.Version++
+	}
+
+	for _, t := range tasks {
+		t.Version++
+	}
+
+	return nil
+}
+
+// getSaved returns the state and version saved under key, or nil if nothing
+// is.
+func getSaved(c redis.Cmdable, key string) (*saved, error) {
+	data, err := c.Get(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
 	if err != nil {
-		return errors.Wrap(err, "error marshalling job")
+		return nil, errors.Wrap(err, "error getting current state")
 	}
 
-	_, err = r.r.Set(fmt.Sprintf("JOB_%s", j.RunID), string(jobData), 0).Result()
+	var current saved
+
+	err = json.Unmarshal([]byte(data), &current)
 	if err != nil {
-		return errors.Wrap(err, "error saving job data")
+		return nil, errors.Wrap(err, "error unmarshalling current state")
+	}
+
+	return &current, nil
+}
+
+// activeJobsKey is the set of jobs that have not reached a terminal state.
+const activeJobsKey = "JOBS_ACTIVE"
+
+// ActiveJobs returns the run IDs of the jobs that have not reached a terminal
+// state.
+func (r *Redis) ActiveJobs() ([]string, error) {
+	runIDs, err := r.r.SMembers(activeJobsKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting active jobs")
+	}
+
+	return runIDs, nil
+}
+
+// Jobs are indexed by sorted sets of run IDs scored by their request time:
+// jobsKey has every job, and the others the jobs with a URL, state or meta
+// data value. ListJobs intersects the sets it filters on.
+const jobsKey = "JOBS"
+
+func urlIndex(u string) string {
+	return "JOBS_URL_" + u
+}
+
+func stateIndex(s bench.State) string {
+	return "JOBS_STATE_" + string(s)
+}
+
+func metaIndex(k, v string) string {
+	return "JOBS_META_" + url.QueryEscape(k) + "=" + url.QueryEscape(v)
+}
+
+// score is the score of a job in the indexes, the microseconds since the
+// epoch of t, which a float64 holds exactly.
+func score(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Microsecond))
+}
+
+// index queues adding the job to the indexes, moving it out of the index of
+// the state it was saved in before.
+func index(pipe redis.Pipeliner, j bench.Job, previous bench.State) {
+	if previous != "" && previous != j.State {
+		pipe.ZRem(stateIndex(previous), j.RunID)
+	}
+
+	keys := []string{jobsKey, urlIndex(j.URL), stateIndex(j.State)}
+	for k, v := range j.MetaData {
+		keys = append(keys, metaIndex(k, v))
 	}
 
-	for _, t := range j.Tasks {
-		err = r.SaveTask(j.RunID, t)
+	member := redis.Z{Score: score(j.RequestTime), Member: j.RunID}
+
+	for _, key := range keys {
+		pipe.ZAdd(key, member)
+	}
+}
+
+// ListJobs returns the page of jobs matching q, newest first, without their
+// tasks. Jobs saved before the indexes existed are not listed.
+func (r *Redis) ListJobs(q JobQuery) (JobList, error) {
+	list := JobList{
+		Jobs: []bench.Job{},
+	}
+
+	keys := []string{jobsKey}
+
+	if q.URL != "" {
+		keys = append(keys, urlIndex(q.URL))
+	}
+
+	if q.State != "" {
+		keys = append(keys, stateIndex(q.State))
+	}
+
+	for k, v := range q.Meta {
+		keys = append(keys, metaIndex(k, v))
+	}
+
+	key := jobsKey
+
+	if len(keys) > 1 {
+		key = "JOBS_QUERY_" + uuid.New().String()
+
+		_, err := r.r.ZInterStore(key, redis.ZStore{Aggregate: "MIN"}, keys...).Result()
 		if err != nil {
-			return errors.Wrap(err, "error saving task")
+			return list, errors.Wrap(err, "error filtering jobs")
 		}
 
-		_, err = r.r.SAdd(fmt.Sprintf("JOB_%s_TASKS", j.RunID), t.ID).Result()
+		defer r.r.Del(key)
+	}
+
+	min, max := "-inf", "+inf"
+
+	if !q.From.IsZero() {
+		min = strconv.FormatFloat(score(q.From), 'f', -1, 64)
+	}
+
+	if !q.To.IsZero() {
+		max = "(" + strconv.FormatFloat(score(q.To), 'f', -1, 64)
+	}
+
+	total, err := r.r.ZCount(key, min, max).Result()
+	if err != nil {
+		return list, errors.Wrap(err, "error counting jobs")
+	}
+
+	list.Total = int(total)
+
+	count := int64(q.Limit)
+	if count <= 0 {
+		count = -1
+	}
+
+	runIDs, err := r.r.ZRevRangeByScore(key, redis.ZRangeBy{
+		Min:    min,
+		Max:    max,
+		Offset: int64(q.Offset),
+		Count:  count,
+	}).Result()
+	if err != nil {
+		return list, errors.Wrap(err, "error listing jobs")
+	}
+
+	for _, runID := range runIDs {
+		var j bench.Job
+
+		jobData, err := r.r.Get(jobKey(runID)).Result()
+		if err == redis.Nil {
+			// The job was purged since the index was read.
+			list.Total--
+			continue
+		}
+
+		if err != nil {
+			return list, errors.Wrap(err, "error getting job data")
+		}
+
+		err = json.Unmarshal([]byte(jobData), &j)
 		if err != nil {
-			return errors.Wrap(err, "error saving task id")
+			return list, errors.Wrap(err, "error unmarshalling job")
 		}
+
+		j.Tasks = nil
+
+		list.Jobs = append(list.Jobs, j)
 	}
 
-	return nil
+	return list, nil
 }
 
 func (r *Redis) GetJob(runID string) (bench.Job, error) {
@@ -60,7 +361,7 @@ func (r *Redis) GetJob(runID string) (bench.Job, error) {
 
 	log.Println(fmt.Sprintf("JOB_%s", runID))
 
-	jobData, err := r.r.Get(fmt.Sprintf("JOB_%s", runID)).Result()
+	jobData, err := r.r.Get(jobKey(runID)).Result()
 	if err != nil {
 		return j, errors.Wrap(err, "error getting job data")
 	}
@@ -70,7 +371,7 @@ func (r *Redis) GetJob(runID string) (bench.Job, error) {
 		return j, errors.Wrap(err, "error unmarshalling job")
 	}
 
-	taskIDs, err := r.r.SMembers(fmt.Sprintf("JOB_%s_TASKS", runID)).Result()
+	taskIDs, err := r.r.SMembers(tasksKey(runID)).Result()
 	if err != nil {
 		return j, errors.Wrap(err, "error getting tasks data")
 	}
@@ -79,6 +380,11 @@ func (r *Redis) GetJob(runID string) (bench.Job, error) {
 
 	for _, taskID := range taskIDs {
 		t, err := r.GetTask(runID, taskID)
+		if errors.Cause(err) == redis.Nil {
+			// The task was purged since its job was read.
+			continue
+		}
+
 		if err != nil {
 			return j, errors.Wrap(err, "error getting task")
 		}
@@ -94,7 +400,7 @@ func (r *Redis) GetTask(runID, taskID string) (bench.Task, error) {
 
 	log.Println("GET", fmt.Sprintf("JOB_%s_TASK_%s", runID, taskID))
 
-	taskData, err := r.r.Get(fmt.Sprintf("JOB_%s_TASK_%s", runID, taskID)).Result()
+	taskData, err := r.r.Get(taskKey(runID, taskID)).Result()
 	if err != nil {
 		return t, errors.Wrap(err, "error getting task data")
 	}
@@ -107,16 +413,213 @@ func (r *Redis) GetTask(runID, taskID string) (bench.Task, error) {
 	return t, nil
 }
 
-func (r *Redis) SaveTask(runID string, t bench.Task) error {
-	taskData, err := json.Marshal(&t)
+// SaveTask saves the task. It fails like SaveJob.
+func (r *Redis) SaveTask(runID string, t *bench.Task) error {
+	return r.save(runID, nil, t)
+}
+
+// ModifyTask applies f to the saved task and saves it, starting again if the
+// task is saved by someone else in the meantime. It returns the saved task.
+func (r *Redis) ModifyTask(runID, taskID string, f func(t *bench.Task) error) (bench.Task, error) {
+	return modifyTask(r, runID, taskID, f)
+}
+
+func dataKey(runID, name string) string {
+	return fmt.Sprintf("JOB_%s_DATA_%s", runID, name)
+}
+
+// dataNamesKey is the set of the names of the data files of a job.
+func dataNamesKey(runID string) string {
+	return fmt.Sprintf("JOB_%s_DATA", runID)
+}
+
+func (r *Redis) SaveData(runID, name string, data []byte) error {
+	_, err := r.r.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(dataKey(runID, name), data, 0)
+		pipe.SAdd(dataNamesKey(runID), name)
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "error marshalling task")
+		return errors.Wrap(err, "error saving data")
 	}
 
-	_, err = r.r.Set(fmt.Sprintf("JOB_%s_TASK_%s", runID, t.ID), string(taskData), 0).Result()
+	return nil
+}
+
+func (r *Redis) GetData(runID, name string) ([]byte, error) {
+	data, err := r.r.Get(dataKey(runID, name)).Bytes()
 	if err != nil {
-		return errors.Wrap(err, "error saving task data")
+		return nil, errors.Wrap(err, "error getting data")
+	}
+
+	return data, nil
+}
+
+// Jobs that have ended are in endedJobsKey, scored by their end time, until
+// they are retired. Retired jobs are in rawExpiringJobsKey and
+// expiringJobsKey, scored by when their raw records and the jobs themselves
+// expire, until Purge deletes them. The indexes a job has to be taken out of
+// are in its indexesKey.
+const (
+	endedJobsKey       = "JOBS_ENDED"
+	rawExpiringJobsKey = "JOBS_RAW_EXPIRING"
+	expiringJobsKey    = "JOBS_EXPIRING"
+)
+
+func summaryKey(runID string) string {
+	return fmt.Sprintf("JOB_%s_SUMMARY", runID)
+}
+
+func indexesKey(runID string) string {
+	return fmt.Sprintf("JOB_%s_INDEXES", runID)
+}
+
+// EndedJobs returns the run IDs of the jobs that ended before before and have
+// not been retired.
+func (r *Redis) EndedJobs(before time.Time) ([]string, error) {
+	runIDs, err := r.r.ZRangeByScore(endedJobsKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatFloat(score(before), 'f', -1, 64),
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting ended jobs")
+	}
+
+	return runIDs, nil
+}
+
+// RetireJob saves the compacted result of a job that ended and sets when its
+// records expire as set by retention. Purge deletes them once they have.
+func (r *Redis) RetireJob(runID string, summary []byte, retention Retention) error {
+	j, err := r.GetJob(runID)
+	if err != nil {
+		return errors.Wrap(err, "error getting job")
+	}
+
+	now := time.Now()
+
+	_, err = r.r.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(summaryKey(runID), summary, 0)
+
+		if raw := retention.raw(); raw > 0 {
+			pipe.ZAdd(rawExpiringJobsKey, redis.Z{
+				Score:  score(now.Add(raw)),
+				Member: runID,
+			})
+		}
+
+		if retention.Summary > 0 {
+			indexes := []interface{}{jobsKey, urlIndex(j.URL), stateIndex(j.State)}
+			for k, v := range j.MetaData {
+				indexes = append(indexes, metaIndex(k, v))
+			}
+
+			pipe.SAdd(indexesKey(runID), indexes...)
+			pipe.ZAdd(expiringJobsKey, redis.Z{
+				Score:  score(now.Add(retention.Summary)),
+				Member: runID,
+			})
+		}
+
+		pipe.ZRem(endedJobsKey, runID)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error retiring job")
 	}
 
 	return nil
 }
+
+// GetSummary returns the compacted result of a retired job.
+func (r *Redis) GetSummary(runID string) ([]byte, error) {
+	data, err := r.r.Get(summaryKey(runID)).Bytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting summary")
+	}
+
+	return data, nil
+}
+
+// Purge deletes the records of retired jobs that expired by now. Raw records
+// never outlive their job, so they are gone by the time the job is.
+func (r *Redis) Purge(now time.Time) error {
+	runIDs, err := r.expired(rawExpiringJobsKey, now)
+	if err != nil {
+		return err
+	}
+
+	for _, runID := range runIDs {
+		taskIDs, err := r.r.SMembers(tasksKey(runID)).Result()
+		if err != nil {
+			return errors.Wrap(err, "error getting tasks")
+		}
+
+		names, err := r.r.SMembers(dataNamesKey(runID)).Result()
+		if err != nil {
+			return errors.Wrap(err, "error getting data names")
+		}
+
+		keys := []string{tasksKey(runID), dataNamesKey(runID)}
+
+		for _, taskID := range taskIDs {
+			keys = append(keys, taskKey(runID, taskID))
+		}
+
+		for _, name := range names {
+			keys = append(keys, dataKey(runID, name))
+		}
+
+		_, err = r.r.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(keys...)
+			pipe.ZRem(rawExpiringJobsKey, runID)
+
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "error purging tasks")
+		}
+	}
+
+	runIDs, err = r.expired(expiringJobsKey, now)
+	if err != nil {
+		return err
+	}
+
+	for _, runID := range runIDs {
+		indexes, err := r.r.SMembers(indexesKey(runID)).Result()
+		if err != nil {
+			return errors.Wrap(err, "error getting indexes")
+		}
+
+		_, err = r.r.TxPipelined(func(pipe redis.Pipeliner) error {
+			for _, index := range indexes {
+				pipe.ZRem(index, runID)
+			}
+
+			pipe.Del(jobKey(runID), summaryKey(runID), indexesKey(runID))
+			pipe.ZRem(expiringJobsKey, runID)
+
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "error purging job")
+		}
+	}
+
+	return nil
+}
+
+// expired returns the run IDs in key that expired by now.
+func (r *Redis) expired(key string, now time.Time) ([]string, error) {
+	runIDs, err := r.r.ZRangeByScore(key, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatFloat(score(now), 'f', -1, 64),
+	}).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting expired jobs")
+	}
+
+	return runIDs, nil
+}
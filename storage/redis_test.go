@@ -0,0 +1,31 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis"
+
+	"github.com/rickbassham/bench/storage"
+	"github.com/rickbassham/bench/storage/storagetest"
+)
+
+// TestRedis needs a Redis server it may empty, set in BENCH_TEST_REDIS_ADDR.
+func TestRedis(t *testing.T) {
+	addr := os.Getenv("BENCH_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("BENCH_TEST_REDIS_ADDR is not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	storagetest.Run(t, func(t *testing.T) (storagetest.Store, func()) {
+		err := client.FlushDB().Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return storage.NewRedis(client), func() {}
+	})
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"time"
+)
+
+// Retention is how long the records of a job are kept once it is retired,
+// that is once it has ended, been archived and had its result compacted. Zero
+// keeps them forever.
+type Retention struct {
+	// Raw is how long the tasks of the job, with their full results and
+	// logs, and its data files are kept.
+	Raw time.Duration
+	// Summary is how long the job itself and its compacted result are kept.
+	Summary time.Duration
+}
+
+// expires returns when a record kept for ttl from now expires, or the zero
+// time if it is kept forever.
+func expires(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(ttl)
+}
+
+// raw returns how long raw records are kept, which is never longer than the
+// job they belong to.
+func (r Retention) raw() time.Duration {
+	if r.Summary > 0 && (r.Raw <= 0 || r.Raw > r.Summary) {
+		return r.Summary
+	}
+
+	return r.Raw
+}
@@ -0,0 +1,712 @@
+// Package storagetest is a conformance suite for the storage backends of
+// benchapi. Every backend must pass Run.
+package storagetest
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+	"github.com/rickbassham/bench/storage"
+)
+
+// Store is the storage used by benchapi.
+type Store interface {
+	SaveTask(runID string, t *bench.Task) error
+	ModifyTask(runID, taskID string, f func(t *bench.Task) error) (bench.Task, error)
+	GetTask(runID, taskID string) (bench.Task, error)
+	AddTask(runID string, t *bench.Task) error
+	SaveJob(j *bench.Job) error
+	UpdateJob(j *bench.Job) error
+	GetJob(runID string) (bench.Job, error)
+	ActiveJobs() ([]string, error)
+	ListJobs(q storage.JobQuery) (storage.JobList, error)
+	SaveData(runID, name string, data []byte) error
+	GetData(runID, name string) ([]byte, error)
+	EndedJobs(before time.Time) ([]string, error)
+	RetireJob(runID string, summary []byte, retention storage.Retention) error
+	GetSummary(runID string) ([]byte, error)
+	Purge(now time.Time) error
+}
+
+// Run runs the suite, calling newStore for an empty store for each test and
+// the function it returns once the test is done with it.
+func Run(t *testing.T, newStore func(t *testing.T) (Store, func())) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"Job", testJob},
+		{"Task", testTask},
+		{"AddTask", testAddTask},
+		{"UpdateJob", testUpdateJob},
+		{"Transition", testTransition},
+		{"Version", testVersion},
+		{"SaveJobConflict", testSaveJobConflict},
+		{"ModifyTask", testModifyTask},
+		{"ActiveJobs", testActiveJobs},
+		{"ListJobs", testListJobs},
+		{"Data", testData},
+		{"Retire", testRetire},
+		{"Missing", testMissing},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s, done := newStore(t)
+			defer done()
+
+			tt.test(t, s)
+		})
+	}
+}
+
+var at = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newJob(runID string, tasks ...string) bench.Job {
+	j := bench.Job{
+		RunID:       runID,
+		Concurrency: 10,
+		Duration:    time.Minute,
+		URL:         "http://example.com/",
+		MetaData:    map[string]string{"team": "a"},
+		RequestTime: at,
+	}
+
+	j.Transition(bench.StatePending, at)
+
+	for _, id := range tasks {
+		j.Tasks = append(j.Tasks, newTask(id))
+	}
+
+	return j
+}
+
+func newTask(id string) bench.Task {
+	task := bench.Task{
+		ID:          id,
+		Concurrency: 5,
+		Env:         map[string]string{"BENCH_RUNNER_ID": id},
+	}
+
+	task.Transition(bench.StatePending, at)
+
+	return task
+}
+
+func taskIDs(j bench.Job) []string {
+	var ids []string
+	for _, task := range j.Tasks {
+		ids = append(ids, task.ID)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func testJob(t *testing.T, s Store) {
+	j := newJob("run1", "a", "b")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	got, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.RunID != "run1" || got.URL != j.URL || got.Duration != j.Duration || got.MetaData["team"] != "a" {
+		t.Errorf("expected the saved job, got %+v", got)
+	}
+
+	if got.State != bench.StatePending || len(got.History) != 1 || !got.RequestTime.Equal(at) {
+		t.Errorf("expected the state and history of the job, got %s %+v", got.State, got.History)
+	}
+
+	if ids := taskIDs(got); !equal(ids, []string{"a", "b"}) {
+		t.Errorf("expected tasks a and b, got %v", ids)
+	}
+}
+
+func testTask(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	task := j.Tasks[0]
+	task.Transition(bench.StateProvisioning, at)
+	task.ContainerID = "container"
+	task.Result = &bench.Result{Requests: 42}
+
+	if err := s.SaveTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	got, err := s.GetTask("run1", "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.State != bench.StateProvisioning || got.ContainerID != "container" || got.Result == nil || got.Result.Requests != 42 {
+		t.Errorf("expected the saved task, got %+v", got)
+	}
+
+	j, err = s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if len(j.Tasks) != 1 || j.Tasks[0].State != bench.StateProvisioning {
+		t.Errorf("expected the job to have the saved task, got %+v", j.Tasks)
+	}
+}
+
+func testAddTask(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	task := newTask("b")
+
+	if err := s.AddTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if ids := taskIDs(j); !equal(ids, []string{"a", "b"}) {
+		t.Errorf("expected tasks a and b, got %v", ids)
+	}
+}
+
+func testUpdateJob(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	task := j.Tasks[0]
+	task.Transition(bench.StateProvisioning, at)
+
+	if err := s.SaveTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j.Transition(bench.StateProvisioning, at)
+
+	if err := s.UpdateJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	got, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.State != bench.StateProvisioning {
+		t.Errorf("expected the job to be updated, got %s", got.State)
+	}
+
+	if len(got.Tasks) != 1 || got.Tasks[0].State != bench.StateProvisioning {
+		t.Errorf("expected updating the job to leave its tasks alone, got %+v", got.Tasks)
+	}
+}
+
+func testTransition(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j.Transition(bench.StateCancelled, at)
+
+	if err := s.UpdateJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// A current job that skips the checks of Transition.
+	j.State = bench.StateProvisioning
+	j.History = j.History[:1]
+
+	if err := s.UpdateJob(&j); errors.Cause(err) != bench.ErrInvalidTransition {
+		t.Errorf("expected a job to only move on from the saved state, got %v", err)
+	}
+
+	task := j.Tasks[0]
+	task.Transition(bench.StateCancelled, at)
+
+	if err := s.SaveTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	task.State = bench.StatePending
+	task.History = task.History[:1]
+
+	if err := s.SaveTask("run1", &task); errors.Cause(err) != bench.ErrInvalidTransition {
+		t.Errorf("expected a task to only move on from the saved state, got %v", err)
+	}
+
+	got, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.State != bench.StateCancelled || len(got.Tasks) != 1 || got.Tasks[0].State != bench.StateCancelled {
+		t.Errorf("expected rejected saves to leave the job alone, got %+v", got)
+	}
+}
+
+func testVersion(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if j.Version != 1 || j.Tasks[0].Version != 1 {
+		t.Errorf("expected saving to bump the versions, got %d and %d", j.Version, j.Tasks[0].Version)
+	}
+
+	stale := j
+
+	j.Transition(bench.StateProvisioning, at)
+
+	if err := s.UpdateJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := s.UpdateJob(&stale); errors.Cause(err) != storage.ErrVersionConflict {
+		t.Errorf("expected a stale job to be rejected, got %v", err)
+	}
+
+	task, staleTask := j.Tasks[0], j.Tasks[0]
+	task.Heartbeat = at
+
+	if err := s.SaveTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	staleTask.Result = &bench.Result{Requests: 1}
+
+	if err := s.SaveTask("run1", &staleTask); errors.Cause(err) != storage.ErrVersionConflict {
+		t.Errorf("expected a stale task to be rejected, got %v", err)
+	}
+
+	missing := newTask("b")
+	missing.Version = 3
+
+	if err := s.SaveTask("run1", &missing); errors.Cause(err) != storage.ErrVersionConflict {
+		t.Errorf("expected a task that is no longer saved to be rejected, got %v", err)
+	}
+
+	got, err := s.GetTask("run1", "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.Version != 2 || !got.Heartbeat.Equal(at) || got.Result != nil {
+		t.Errorf("expected the task saved first to be kept, got %+v", got)
+	}
+}
+
+func testSaveJobConflict(t *testing.T, s Store) {
+	j := newJob("run1", "a", "b")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	task := j.Tasks[1]
+	task.Heartbeat = at
+
+	if err := s.SaveTask("run1", &task); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j.Transition(bench.StateProvisioning, at)
+	j.Tasks[0].Transition(bench.StateProvisioning, at)
+	j.Tasks[1].Transition(bench.StateProvisioning, at)
+
+	if err := s.SaveJob(&j); errors.Cause(err) != storage.ErrVersionConflict {
+		t.Fatalf("expected a job with a stale task to be rejected, got %v", err)
+	}
+
+	if j.Version != 1 || j.Tasks[0].Version != 1 {
+		t.Errorf("expected a rejected save to leave the versions alone, got %d and %d", j.Version, j.Tasks[0].Version)
+	}
+
+	got, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.State != bench.StatePending {
+		t.Errorf("expected the job not to be saved, got %s", got.State)
+	}
+
+	for _, task := range got.Tasks {
+		if task.State != bench.StatePending {
+			t.Errorf("expected task %s not to be saved, got %s", task.ID, task.State)
+		}
+	}
+}
+
+func testModifyTask(t *testing.T, s Store) {
+	j := newJob("run1", "a")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Each save that conflicts loses to another that succeeds, so none of
+	// them runs out of attempts.
+	const n = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := s.ModifyTask("run1", "a", func(task *bench.Task) error {
+				task.Concurrency++
+				return nil
+			})
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("%+v", err)
+	}
+
+	got, err := s.GetTask("run1", "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.Concurrency != 5+n || got.Version != 1+n {
+		t.Errorf("expected every change to be kept, got concurrency %d at version %d", got.Concurrency, got.Version)
+	}
+
+	failed := errors.New("failed")
+
+	_, err = s.ModifyTask("run1", "a", func(task *bench.Task) error {
+		task.Concurrency = 0
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected the error of the change, got %v", err)
+	}
+
+	got, err = s.GetTask("run1", "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if got.Concurrency != 5+n {
+		t.Errorf("expected a failed change not to be saved, got %d", got.Concurrency)
+	}
+}
+
+func testActiveJobs(t *testing.T, s Store) {
+	for _, runID := range []string{"run1", "run2", "run3"} {
+		j := newJob(runID)
+
+		if err := s.SaveJob(&j); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	j, err := s.GetJob("run2")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j.Transition(bench.StateFailed, at)
+
+	if err := s.UpdateJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	runIDs, err := s.ActiveJobs()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	sort.Strings(runIDs)
+
+	if !equal(runIDs, []string{"run1", "run3"}) {
+		t.Errorf("expected run1 and run3 to be active, got %v", runIDs)
+	}
+}
+
+func testListJobs(t *testing.T, s Store) {
+	for i, runID := range []string{"run1", "run2", "run3", "run4", "run5"} {
+		j := newJob(runID)
+		j.RequestTime = at.Add(time.Duration(i) * time.Hour)
+
+		if i%2 == 1 {
+			j.URL = "http://example.com/other"
+		}
+
+		if i >= 3 {
+			j.MetaData["commit"] = "abc123"
+		}
+
+		if err := s.SaveJob(&j); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	j, err := s.GetJob("run3")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := j.Transition(bench.StateCancelled, at); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := s.UpdateJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	tests := []struct {
+		name  string
+		q     storage.JobQuery
+		jobs  []string
+		total int
+	}{
+		{"all", storage.JobQuery{}, []string{"run5", "run4", "run3", "run2", "run1"}, 5},
+		{"page", storage.JobQuery{Offset: 1, Limit: 2}, []string{"run4", "run3"}, 5},
+		{"past the end", storage.JobQuery{Offset: 5, Limit: 2}, []string{}, 5},
+		{"url", storage.JobQuery{URL: "http://example.com/other"}, []string{"run4", "run2"}, 2},
+		{"state", storage.JobQuery{State: bench.StateCancelled}, []string{"run3"}, 1},
+		{"old state", storage.JobQuery{State: bench.StatePending}, []string{"run5", "run4", "run2", "run1"}, 4},
+		{"from", storage.JobQuery{From: at.Add(time.Hour)}, []string{"run5", "run4", "run3", "run2"}, 4},
+		{"to", storage.JobQuery{To: at.Add(time.Hour)}, []string{"run1"}, 1},
+		{"meta", storage.JobQuery{Meta: map[string]string{"team": "a", "commit": "abc123"}}, []string{"run5", "run4"}, 2},
+		{"meta and url", storage.JobQuery{URL: "http://example.com/other", Meta: map[string]string{"commit": "abc123"}, Limit: 10}, []string{"run4"}, 1},
+		{"no match", storage.JobQuery{Meta: map[string]string{"team": "b"}}, []string{}, 0},
+	}
+
+	for _, tt := range tests {
+		list, err := s.ListJobs(tt.q)
+		if err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+
+		runIDs := []string{}
+		for _, j := range list.Jobs {
+			runIDs = append(runIDs, j.RunID)
+		}
+
+		if !equal(runIDs, tt.jobs) || list.Total != tt.total {
+			t.Errorf("%s: expected %v of %d, got %v of %d", tt.name, tt.jobs, tt.total, runIDs, list.Total)
+		}
+	}
+}
+
+func testData(t *testing.T, s Store) {
+	j := newJob("run1")
+
+	if err := s.SaveJob(&j); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	data := []byte("id\n1\n2\n")
+
+	if err := s.SaveData("run1", "ids.csv", data); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := s.SaveData("run1", "other.csv", []byte("x")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	got, err := s.GetData("run1", "ids.csv")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+}
+
+func testRetire(t *testing.T, s Store) {
+	for i, runID := range []string{"run1", "run2", "run3"} {
+		j := newJob(runID, "a", "b")
+
+		if i < 2 {
+			if err := j.Transition(bench.StateCancelled, at.Add(time.Duration(i)*2*time.Hour)); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+
+		if err := s.SaveJob(&j); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		if err := s.SaveData(runID, "ids.csv", []byte("id\n1\n")); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	ended := func(before time.Time, expected ...string) {
+		t.Helper()
+
+		runIDs, err := s.EndedJobs(before)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		sort.Strings(runIDs)
+
+		if !equal(runIDs, expected) {
+			t.Errorf("expected %v to have ended before %s, got %v", expected, before, runIDs)
+		}
+	}
+
+	ended(at)
+	ended(at.Add(time.Hour), "run1")
+	ended(at.Add(3*time.Hour), "run1", "run2")
+
+	summary := []byte(`{"runId":"run1"}`)
+
+	if err := s.RetireJob("run1", summary, storage.Retention{Raw: time.Hour, Summary: 2 * time.Hour}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := s.RetireJob("run2", []byte(`{"runId":"run2"}`), storage.Retention{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ended(at.Add(3 * time.Hour))
+
+	got, err := s.GetSummary("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if !bytes.Equal(got, summary) {
+		t.Errorf("expected summary %q, got %q", summary, got)
+	}
+
+	if _, err := s.GetSummary("run3"); err == nil {
+		t.Errorf("expected an error getting the summary of a job that was not retired")
+	}
+
+	start := time.Now()
+
+	if err := s.Purge(start.Add(90 * time.Minute)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	j, err := s.GetJob("run1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if len(j.Tasks) != 0 {
+		t.Errorf("expected the tasks to have expired, got %v", taskIDs(j))
+	}
+
+	if _, err := s.GetData("run1", "ids.csv"); err == nil {
+		t.Errorf("expected the data to have expired")
+	}
+
+	if _, err := s.GetSummary("run1"); err != nil {
+		t.Errorf("expected the summary to be kept, got %+v", err)
+	}
+
+	if err := s.Purge(start.Add(3 * time.Hour)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err := s.GetJob("run1"); err == nil {
+		t.Errorf("expected the job to have expired")
+	}
+
+	if _, err := s.GetSummary("run1"); err == nil {
+		t.Errorf("expected the summary to have expired")
+	}
+
+	list, err := s.ListJobs(storage.JobQuery{})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if len(list.Jobs) != 2 || list.Total != 2 {
+		t.Errorf("expected run3 and run2 to be listed, got %d of %d", len(list.Jobs), list.Total)
+	}
+
+	for _, runID := range []string{"run2", "run3"} {
+		j, err := s.GetJob(runID)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		if len(j.Tasks) != 2 {
+			t.Errorf("expected the tasks of %s to be kept, got %v", runID, taskIDs(j))
+		}
+
+		if _, err := s.GetData(runID, "ids.csv"); err != nil {
+			t.Errorf("expected the data of %s to be kept, got %+v", runID, err)
+		}
+	}
+}
+
+func testMissing(t *testing.T, s Store) {
+	if _, err := s.GetJob("missing"); err == nil {
+		t.Errorf("expected an error getting a missing job")
+	}
+
+	if _, err := s.GetTask("missing", "a"); err == nil {
+		t.Errorf("expected an error getting a missing task")
+	}
+
+	if _, err := s.GetData("missing", "ids.csv"); err == nil {
+		t.Errorf("expected an error getting missing data")
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rickbassham/bench"
+)
+
+// ErrVersionConflict is returned when saving a job or task that has been saved
+// by someone else since it was read.
+var ErrVersionConflict = errors.New("version conflict")
+
+// modifyAttempts is how many times ModifyTask tries to save a task before
+// giving up on a conflict.
+const modifyAttempts = 10
+
+// saved is the state and version of a saved job or task.
+type saved struct {
+	State   bench.State `json:"state"`
+	Version int64       `json:"version"`
+}
+
+// check makes sure a job or task read at version, with the given state and
+// history, may replace the saved one: it must not have been saved since it was
+// read, and must follow it, see bench.Follows. A nil saved is one that has not
+// been saved yet.
+func (s *saved) check(version int64, state bench.State, history []bench.Transition) error {
+	if s == nil {
+		if version != 0 {
+			return errors.Wrapf(ErrVersionConflict, "version %d is no longer saved", version)
+		}
+
+		return nil
+	}
+
+	if s.Version != version {
+		return errors.Wrapf(ErrVersionConflict, "saved version is %d, not %d", s.Version, version)
+	}
+
+	if !bench.Follows(s.State, state, history) {
+		return errors.Wrapf(bench.ErrInvalidTransition, "%q to %q", s.State, state)
+	}
+
+	return nil
+}
+
+type taskStore interface {
+	GetTask(runID, taskID string) (bench.Task, error)
+	SaveTask(runID string, t *bench.Task) error
+}
+
+// modifyTask reads a task, applies f to it and saves it, starting again from
+// the newly saved task if it was saved by someone else in the meantime. An
+// error from f is returned as is, without saving.
+func modifyTask(s taskStore, runID, taskID string, f func(t *bench.Task) error) (bench.Task, error) {
+	for attempt := 1; ; attempt++ {
+		t, err := s.GetTask(runID, taskID)
+		if err != nil {
+			return t, err
+		}
+
+		err = f(&t)
+		if err != nil {
+			return t, err
+		}
+
+		err = s.SaveTask(runID, &t)
+		if errors.Cause(err) == ErrVersionConflict && attempt < modifyAttempts {
+			continue
+		}
+
+		return t, err
+	}
+}
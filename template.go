@@ -0,0 +1,222 @@
+package bench
+
+import (
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// UserReplacer is implemented by Replacers that keep per virtual user state.
+// The Runner calls ForUser once for every virtual user it starts.
+type UserReplacer interface {
+	Replacer
+	ForUser(index int) Replacer
+}
+
+// placeholder matches {name} and {name:args}.
+var placeholder = regexp.MustCompile(`\{([a-zA-Z][a-zA-Z0-9_]*)(?::([^{}]*))?\}`)
+
+type generator func(t *TemplateReplacer) string
+
+type templateShared struct {
+	aliases map[string]generator
+	cache   sync.Map
+	seq     int64
+}
+
+// TemplateReplacer expands generator placeholders in templates:
+//
+//	{randInt:min:max}  random integer in [min, max]
+//	{uuid}             random UUID
+//	{seq}              counter shared by every virtual user, starting at 1
+//	{vuSeq}            counter of the current virtual user, starting at 1
+//	{vu}               index of the current virtual user
+//	{now:format}       current time in a Go layout, "unix" or "unixMilli"
+//	{randString:n}     random alphanumeric string of length n
+//	{pick:a|b|c}       one of the listed values at random
+//
+// Named generators give a placeholder to an expression, so {id} can stand for
+// randInt:1:5000000. Placeholders that are neither are left untouched.
+type TemplateReplacer struct {
+	*templateShared
+
+	vu    int
+	vuSeq *int64
+}
+
+// NewTemplateReplacer returns a TemplateReplacer with the given named
+// generators, mapping a placeholder name to a generator expression such as
+// "randInt:1:100".
+func NewTemplateReplacer(generators map[string]string) (*TemplateReplacer, error) {
+	shared := &templateShared{
+		aliases: map[string]generator{},
+	}
+
+	for name, expr := range generators {
+		parts := strings.SplitN(expr, ":", 2)
+
+		var args string
+		if len(parts) > 1 {
+			args = parts[1]
+		}
+
+		g, err := parseGenerator(parts[0], args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "generator %s", name)
+		}
+
+		shared.aliases[name] = g
+	}
+
+	return &TemplateReplacer{
+		templateShared: shared,
+		vuSeq:          new(int64),
+	}, nil
+}
+
+// ForUser returns a replacer sharing the named generators and {seq} with t,
+// with its own {vu} and {vuSeq}.
+func (t *TemplateReplacer) ForUser(index int) Replacer {
+	return &TemplateReplacer{
+		templateShared: t.templateShared,
+		vu:             index,
+		vuSeq:          new(int64),
+	}
+}
+
+func (t *TemplateReplacer) Replace(s string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+
+	return placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		g := t.lookup(m)
+		if g == nil {
+			return m
+		}
+
+		return g(t)
+	})
+}
+
+func (t *TemplateReplacer) lookup(m string) generator {
+	if g, ok := t.cache.Load(m); ok {
+		return g.(generator)
+	}
+
+	sub := placeholder.FindStringSubmatch(m)
+
+	g, ok := t.aliases[sub[1]]
+	if !ok || sub[2] != "" {
+		var err error
+
+		g, err = parseGenerator(sub[1], sub[2])
+		if err != nil {
+			g = nil
+		}
+	}
+
+	// Unknown placeholders are cached too, so they are only parsed once.
+	t.cache.Store(m, g)
+
+	return g
+}
+
+func parseGenerator(name, args string) (generator, error) {
+	switch name {
+	case "randInt":
+		parts := strings.Split(args, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("randInt needs min and max")
+		}
+
+		min, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing randInt min")
+		}
+
+		max, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing randInt max")
+		}
+
+		if max < min {
+			return nil, errors.New("randInt max must be >= min")
+		}
+
+		return func(*TemplateReplacer) string {
+			return strconv.FormatInt(min+rand.Int63n(max-min+1), 10)
+		}, nil
+	case "uuid":
+		return func(*TemplateReplacer) string {
+			return uuid.New().String()
+		}, nil
+	case "seq":
+		return func(t *TemplateReplacer) string {
+			return strconv.FormatInt(atomic.AddInt64(&t.seq, 1), 10)
+		}, nil
+	case "vuSeq":
+		return func(t *TemplateReplacer) string {
+			return strconv.FormatInt(atomic.AddInt64(t.vuSeq, 1), 10)
+		}, nil
+	case "vu":
+		return func(t *TemplateReplacer) string {
+			return strconv.Itoa(t.vu)
+		}, nil
+	case "now":
+		switch args {
+		case "":
+			args = time.RFC3339
+		case "unix":
+			return func(*TemplateReplacer) string {
+				return strconv.FormatInt(time.Now().Unix(), 10)
+			}, nil
+		case "unixMilli":
+			return func(*TemplateReplacer) string {
+				return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+			}, nil
+		}
+
+		return func(*TemplateReplacer) string {
+			return time.Now().Format(args)
+		}, nil
+	case "randString":
+		n, err := strconv.Atoi(args)
+		if err != nil || n <= 0 {
+			return nil, errors.New("randString needs a length > 0")
+		}
+
+		return func(*TemplateReplacer) string {
+			return randString(n)
+		}, nil
+	case "pick":
+		values := strings.Split(args, "|")
+		if args == "" {
+			return nil, errors.New("pick needs at least one value")
+		}
+
+		return func(*TemplateReplacer) string {
+			return values[rand.Intn(len(values))]
+		}, nil
+	}
+
+	return nil, errors.Errorf("unknown generator %q", name)
+}
+
+const randStringChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func randString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = randStringChars[rand.Intn(len(randStringChars))]
+	}
+
+	return string(b)
+}
@@ -0,0 +1,71 @@
+package bench_test
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestTemplateReplacer(t *testing.T) {
+	tr, err := bench.NewTemplateReplacer(map[string]string{
+		"id": "randInt:5:7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		id, _ := strconv.Atoi(tr.Replace("{id}"))
+		if id < 5 || id > 7 {
+			t.Fatalf("expected id in [5, 7], got %d", id)
+		}
+	}
+
+	cases := map[string]*regexp.Regexp{
+		"/items/{randInt:1:1}":      regexp.MustCompile(`^/items/1$`),
+		"{uuid}":                    regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+		"{randString:12}":           regexp.MustCompile(`^[a-zA-Z0-9]{12}$`),
+		"{pick:a|b}":                regexp.MustCompile(`^(a|b)$`),
+		"{now:2006-01-02T15:04:05}": regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}$`),
+		"{unknown} {token}":         regexp.MustCompile(`^\{unknown\} \{token\}$`),
+	}
+
+	for template, want := range cases {
+		if got := tr.Replace(template); !want.MatchString(got) {
+			t.Errorf("%s: got %q", template, got)
+		}
+	}
+}
+
+func TestTemplateReplacerCounters(t *testing.T) {
+	tr, err := bench.NewTemplateReplacer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tr.ForUser(3)
+	b := tr.ForUser(4)
+
+	if got := a.Replace("{vu}-{vuSeq}-{seq}"); got != "3-1-1" {
+		t.Errorf("expected 3-1-1, got %s", got)
+	}
+
+	if got := b.Replace("{vu}-{vuSeq}-{seq}"); got != "4-1-2" {
+		t.Errorf("expected 4-1-2, got %s", got)
+	}
+
+	if got := a.Replace("{vuSeq}"); got != "2" {
+		t.Errorf("expected 2, got %s", got)
+	}
+}
+
+func TestTemplateReplacerInvalid(t *testing.T) {
+	for _, expr := range []string{"randInt:9:1", "randString:0", "nope"} {
+		_, err := bench.NewTemplateReplacer(map[string]string{"x": expr})
+		if err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
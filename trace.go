@@ -0,0 +1,111 @@
+package bench
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// Request phases recorded in Result.Phases.
+const (
+	PhaseDNS     = "dns"
+	PhaseConnect = "connect"
+	PhaseTLS     = "tls"
+	// PhaseFirstByte is the time from the request being written to the first
+	// byte of the response, which is mostly server think time.
+	PhaseFirstByte = "firstByte"
+	// PhaseBody is the time from the first byte of the response to the body
+	// being read.
+	PhaseBody = "body"
+)
+
+// Phases lists every request phase.
+var Phases = []string{PhaseDNS, PhaseConnect, PhaseTLS, PhaseFirstByte, PhaseBody}
+
+// phaseTimer collects the timestamps of one request through httptrace. The
+// hooks can run on other goroutines, and connect can happen more than once
+// when dialing several addresses, so only the first of each is kept.
+type phaseTimer struct {
+	mu sync.Mutex
+
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wrote, firstByte          time.Time
+}
+
+func setOnce(t *time.Time) {
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+func (p *phaseTimer) mark(t *time.Time) {
+	p.mu.Lock()
+	setOnce(t)
+	p.mu.Unlock()
+}
+
+func (p *phaseTimer) trace(req *http.Request) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { p.mark(&p.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { p.mark(&p.dnsDone) },
+		ConnectStart: func(string, string) {
+			p.mark(&p.connectStart)
+		},
+		ConnectDone: func(string, string, error) {
+			p.mark(&p.connectDone)
+		},
+		TLSHandshakeStart:    func() { p.mark(&p.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { p.mark(&p.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.mark(&p.wrote) },
+		GotFirstResponseByte: func() { p.mark(&p.firstByte) },
+	}))
+}
+
+// phases returns the duration of every phase the request went through. A
+// request on a reused connection has no DNS, connect or TLS phase.
+func (p *phaseTimer) phases(end time.Time) map[string]time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	phases := map[string]time.Duration{}
+
+	add := func(name string, start, done time.Time) {
+		if !start.IsZero() && !done.IsZero() {
+			phases[name] = done.Sub(start)
+		}
+	}
+
+	add(PhaseDNS, p.dnsStart, p.dnsDone)
+	add(PhaseConnect, p.connectStart, p.connectDone)
+	add(PhaseTLS, p.tlsStart, p.tlsDone)
+	add(PhaseFirstByte, p.wrote, p.firstByte)
+	add(PhaseBody, p.firstByte, end)
+
+	return phases
+}
+
+// PhaseHist returns the histogram of a request phase, or nil if the phase was
+// never recorded.
+func (r *Result) PhaseHist(phase string) *hdrhistogram.Histogram {
+	if h, ok := r.phases[phase]; ok {
+		return h
+	}
+
+	if s, ok := r.Phases[phase]; ok && s != nil {
+		if r.phases == nil {
+			r.phases = map[string]*hdrhistogram.Histogram{}
+		}
+
+		r.phases[phase] = hdrhistogram.Import(s)
+
+		return r.phases[phase]
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package bench_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rickbassham/bench"
+)
+
+func TestRunnerPhases(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// The test server uses a self-signed certificate.
+	transport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	defer func() {
+		http.DefaultTransport = transport
+	}()
+
+	spec := bench.HistogramSpec{Resolution: time.Millisecond}
+
+	r := bench.NewRunner(1, 100*time.Millisecond, time.Second, srv.URL, nil, bench.WithHistogram(spec))
+
+	result := r.Run()
+
+	if result.Requests == 0 {
+		t.Fatal("expected requests")
+	}
+
+	for _, phase := range []string{bench.PhaseConnect, bench.PhaseTLS, bench.PhaseFirstByte, bench.PhaseBody} {
+		if result.PhaseHist(phase) == nil {
+			t.Errorf("expected a %s histogram", phase)
+		}
+	}
+
+	// Every request waits for the server, but only the first one connects.
+	if n := result.PhaseHist(bench.PhaseFirstByte).TotalCount(); n != int64(result.Requests) {
+		t.Errorf("expected %d first byte timings, got %d", result.Requests, n)
+	}
+
+	if min := result.PhaseHist(bench.PhaseFirstByte).Min(); min < 20 {
+		t.Errorf("expected first byte to take at least 20ms, got %dms", min)
+	}
+}